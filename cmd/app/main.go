@@ -1,19 +1,25 @@
+// Usage:
+//
+//	app                 start the server (same as `app serve`)
+//	app migrate ...     manage database migrations, see `app migrate`
 package main
 
 import (
 	"context"
 	"log"
 	"log/slog"
-	"path/filepath"
+	"os"
+	// dnd schedules resolve IANA timezones, the runtime image may lack zoneinfo
+	_ "time/tzdata"
 
 	"github.com/ReilBleem13/MessangerV2/internal/config"
+	"github.com/ReilBleem13/MessangerV2/internal/logger"
 	"github.com/ReilBleem13/MessangerV2/internal/repository/cache"
 	"github.com/ReilBleem13/MessangerV2/internal/repository/database"
 	"github.com/ReilBleem13/MessangerV2/internal/server"
-	"github.com/ReilBleem13/MessangerV2/internal/service"
+	"github.com/ReilBleem13/MessangerV2/internal/tracing"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
-	"github.com/pressly/goose/v3"
 )
 
 func main() {
@@ -27,8 +33,42 @@ func main() {
 		return
 	}
 
+	if err := logger.Setup(cfg.Log); err != nil {
+		log.Fatal(err)
+	}
+
+	command := "serve"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	switch command {
+	case "serve":
+		serve(cfg)
+	case "migrate":
+		if err := runMigrate(cfg.Database.DSN(), os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown command %q, expected serve or migrate", command)
+	}
+}
+
+func serve(cfg *config.Config) {
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Warn("Failed to flush traces", "error", err)
+		}
+	}()
+
 	redisAddr := cfg.Redis.Host + ":" + cfg.Redis.Port
-	cache.NewRedisClient(redisAddr)
+	if err := cache.NewRedisClient(redisAddr); err != nil {
+		log.Fatal(err)
+	}
 	slog.Info("Redis inited")
 
 	dsn := cfg.Database.DSN()
@@ -37,26 +77,12 @@ func main() {
 	}
 	slog.Info("Database inited")
 
-	if err := goose.SetDialect("postgres"); err != nil {
-		slog.Error("Failed to set dialect (migrations)", "error", err)
+	if err := database.CheckSchemaVersion(context.Background(), database.Client().DB); err != nil {
+		slog.Error("Database schema is not up to date", "error", err)
 		return
 	}
+	slog.Info("Database schema is up to date")
 
-	migrationsPath := filepath.Join("internal", "repository", "database", "migrations")
-	if err := goose.Up(database.Client().DB, migrationsPath); err != nil {
-		slog.Error("Failed to migrate up", "error", err)
-		return
-	}
-	slog.Info("Migrations completed")
-
-	go service.GetHub().Run()
-
-	server := server.NewServer(
-		context.Background(),
-		cfg,
-		server.WithMigrateDown(func() error {
-			return goose.DownTo(database.Client().DB, migrationsPath, 0)
-		}),
-	)
+	server := server.NewServer(context.Background(), cfg)
 	server.Run(":8080")
 }
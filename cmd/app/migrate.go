@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/ReilBleem13/MessangerV2/internal/repository/database"
+	"github.com/pressly/goose/v3"
+)
+
+const migrateUsage = `usage: app migrate <command> [flags]
+
+commands:
+  up                      apply all pending migrations
+  down [-to N] -confirm   roll back the last migration, or down to version N
+  redo -confirm           roll back the last migration and apply it again
+  status                  print applied and pending migrations
+  create <name> [sql|go]  create a new migration file`
+
+var errNotConfirmed = errors.New("this command drops data, pass -confirm to run it")
+
+// runMigrate does not need a database connection for create and opens one for the rest.
+func runMigrate(dsn string, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	command, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("migrate "+command, flag.ContinueOnError)
+	confirm := fs.Bool("confirm", false, "allow commands that drop data")
+	to := fs.Int64("to", -1, "target version for down")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if command == "create" {
+		if fs.NArg() == 0 {
+			return errors.New(migrateUsage)
+		}
+
+		migrationType := "sql"
+		if fs.NArg() > 1 {
+			migrationType = fs.Arg(1)
+		}
+		return goose.Create(nil, database.MigrationsDir, fs.Arg(0), migrationType)
+	}
+
+	if (command == "down" || command == "redo") && !*confirm {
+		return errNotConfirmed
+	}
+
+	if err := goose.SetDialect(database.Dialect); err != nil {
+		return err
+	}
+
+	if err := database.NewPostgresClient(dsn); err != nil {
+		return err
+	}
+	db := database.Client().DB
+	defer db.Close()
+
+	switch command {
+	case "up":
+		return goose.Up(db, database.MigrationsDir)
+	case "status":
+		return goose.Status(db, database.MigrationsDir)
+	case "down":
+		if *to >= 0 {
+			return goose.DownTo(db, database.MigrationsDir, *to)
+		}
+		return goose.Down(db, database.MigrationsDir)
+	case "redo":
+		return goose.Redo(db, database.MigrationsDir)
+	default:
+		return fmt.Errorf("unknown migrate command %q\n\n%s", command, migrateUsage)
+	}
+}
@@ -2,25 +2,104 @@ package config
 
 import (
 	"fmt"
+	"net/netip"
+	"strings"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 )
 
 type Config struct {
-	App      App
-	Database Database
-	Redis    Redis
-	JWT      JWT
+	App       App
+	Database  Database
+	Redis     Redis
+	JWT       JWT
+	WebSocket WebSocket
+	Tracing   Tracing
+	Log       Log
+	RateLimit RateLimit
+	Uploads   Uploads
 }
 
 type App struct {
 	Port string `env:"PORT" env-required:"true"`
+	// Identifies this instance in the user→node registry, random if empty
+	NodeID string `env:"NODE_ID"`
+	// CIDRs of load balancers allowed to set X-Forwarded-For, the header is ignored for everyone else
+	TrustedProxies []string `env:"TRUSTED_PROXIES" env-separator:","`
+}
+
+func (a App) TrustedProxyPrefixes() ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(a.TrustedProxies))
+	for _, cidr := range a.TrustedProxies {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+type WebSocket struct {
+	SendQueueSize int `env:"WS_SEND_QUEUE_SIZE" env-default:"256"`
+	// drop_ephemeral or disconnect
+	SendQueuePolicy string `env:"WS_SEND_QUEUE_POLICY" env-default:"drop_ephemeral"`
+	// Origins allowed to open a websocket, "*" allows any. If empty the origin must match the host
+	AllowedOrigins []string      `env:"WS_ALLOWED_ORIGINS" env-separator:","`
+	TicketTTL      time.Duration `env:"WS_TICKET_TTL" env-default:"30s"`
+}
+
+type Uploads struct {
+	// bytes
+	MaxAvatarSize int64 `env:"UPLOADS_MAX_AVATAR_SIZE" env-default:"2097152"`
+}
+
+// Token buckets: *_RATE is tokens per second, *_BURST is the bucket size
+type RateLimit struct {
+	// per user on write endpoints (create group, add member, ...)
+	HTTPUserRate  float64 `env:"RATE_LIMIT_HTTP_USER_RATE" env-default:"1"`
+	HTTPUserBurst int     `env:"RATE_LIMIT_HTTP_USER_BURST" env-default:"10"`
+	// per client ip on every API endpoint, checked before authentication
+	HTTPIPRate  float64 `env:"RATE_LIMIT_HTTP_IP_RATE" env-default:"20"`
+	HTTPIPBurst int     `env:"RATE_LIMIT_HTTP_IP_BURST" env-default:"100"`
+
+	// per user for websocket frames
+	SendRate       float64 `env:"RATE_LIMIT_WS_SEND_RATE" env-default:"5"`
+	SendBurst      int     `env:"RATE_LIMIT_WS_SEND_BURST" env-default:"20"`
+	ReadRate       float64 `env:"RATE_LIMIT_WS_READ_RATE" env-default:"20"`
+	ReadBurst      int     `env:"RATE_LIMIT_WS_READ_BURST" env-default:"100"`
+	DeliveredRate  float64 `env:"RATE_LIMIT_WS_DELIVERED_RATE" env-default:"20"`
+	DeliveredBurst int     `env:"RATE_LIMIT_WS_DELIVERED_BURST" env-default:"100"`
+	PresenceRate   float64 `env:"RATE_LIMIT_WS_PRESENCE_RATE" env-default:"2"`
+	PresenceBurst  int     `env:"RATE_LIMIT_WS_PRESENCE_BURST" env-default:"20"`
+	ReauthRate     float64 `env:"RATE_LIMIT_WS_REAUTH_RATE" env-default:"0.1"`
+	ReauthBurst    int     `env:"RATE_LIMIT_WS_REAUTH_BURST" env-default:"3"`
+}
+
+type Log struct {
+	// debug, info, warn or error
+	Level string `env:"LOG_LEVEL" env-default:"info"`
+	// json or text
+	Format string `env:"LOG_FORMAT" env-default:"json"`
+	// user written text is redacted unless explicitly enabled. Redacted attribute keys: content,
+	// new_content, text, status_text, emoji, about, bio, description, name, nickname, query
+	LogContent bool `env:"LOG_MESSAGE_CONTENT" env-default:"false"`
+}
+
+type Tracing struct {
+	// none, stdout or otlp
+	Exporter    string  `env:"TRACING_EXPORTER" env-default:"none"`
+	ServiceName string  `env:"TRACING_SERVICE_NAME" env-default:"messenger"`
+	SampleRatio float64 `env:"TRACING_SAMPLE_RATIO" env-default:"1"`
 }
 
 type JWT struct {
 	Secret                 string `env:"JWT_SECRET" env-required:"true"`
 	AccessExpirationMin    int    `env:"JWT_ACCESS_EXP_MIN" env-required:"true"`
 	RefreshExpirationHours int    `env:"JWT_REFRESH_EXP_HOURS" env-required:"true"`
+	// websocket clients get token_expiring this long before the access token expires
+	ExpiryWarning time.Duration `env:"JWT_EXPIRY_WARNING" env-default:"1m"`
 }
 
 type Redis struct {
@@ -50,5 +129,49 @@ func Load() (*Config, error) {
 	if err := cleanenv.ReadEnv(cfg); err != nil {
 		return nil, fmt.Errorf("read environment variables: %w", err)
 	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
+
+func (c *Config) validate() error {
+	switch c.WebSocket.SendQueuePolicy {
+	case "drop_ephemeral", "disconnect":
+	default:
+		return fmt.Errorf("invalid WS_SEND_QUEUE_POLICY %q: must be drop_ephemeral or disconnect", c.WebSocket.SendQueuePolicy)
+	}
+
+	if _, err := c.App.TrustedProxyPrefixes(); err != nil {
+		return err
+	}
+	return c.RateLimit.validate()
+}
+
+// a zero rate never refills the bucket and a zero burst rejects everything
+func (r RateLimit) validate() error {
+	buckets := []struct {
+		name  string
+		rate  float64
+		burst int
+	}{
+		{"RATE_LIMIT_HTTP_USER", r.HTTPUserRate, r.HTTPUserBurst},
+		{"RATE_LIMIT_HTTP_IP", r.HTTPIPRate, r.HTTPIPBurst},
+		{"RATE_LIMIT_WS_SEND", r.SendRate, r.SendBurst},
+		{"RATE_LIMIT_WS_READ", r.ReadRate, r.ReadBurst},
+		{"RATE_LIMIT_WS_DELIVERED", r.DeliveredRate, r.DeliveredBurst},
+		{"RATE_LIMIT_WS_PRESENCE", r.PresenceRate, r.PresenceBurst},
+		{"RATE_LIMIT_WS_REAUTH", r.ReauthRate, r.ReauthBurst},
+	}
+
+	for _, b := range buckets {
+		if b.rate <= 0 {
+			return fmt.Errorf("%s_RATE must be positive, got %v", b.name, b.rate)
+		}
+		if b.burst <= 0 {
+			return fmt.Errorf("%s_BURST must be positive, got %d", b.name, b.burst)
+		}
+	}
+	return nil
+}
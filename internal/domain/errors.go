@@ -60,6 +60,30 @@ var (
 		Status: 401,
 	}
 
+	ErrServiceUnavailable = &AppError{
+		Code:    "SERVICE_UNAVAILABLE",
+		Message: "Service is shutting down",
+		Status:  503,
+	}
+
+	ErrTooManyRequests = &AppError{
+		Code:    "RATE_LIMITED",
+		Message: "Too many requests",
+		Status:  429,
+	}
+
+	ErrBlocked = &AppError{
+		Code:    "USER_BLOCKED",
+		Message: "User has blocked you",
+		Status:  403,
+	}
+
+	ErrPrivateChatRestricted = &AppError{
+		Code:    "PRIVATE_CHAT_RESTRICTED",
+		Message: "User doesn't accept new chats from you",
+		Status:  403,
+	}
+
 	ErrForbidden = &AppError{
 		Code:    "FORBIDDEN",
 		Message: "Insufficient permissions",
@@ -12,17 +12,88 @@ type Message struct {
 }
 
 type UserChat struct {
-	ID        int       `json:"id" db:"id"`
-	Type      ChatType  `json:"type" db:"type"`
-	Name      *string   `json:"name,omitempty" db:"name"`
-	AuthorID  *int      `json:"author_id,omitempty" db:"author_id"`
-	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	ID          int       `json:"id" db:"id"`
+	Type        ChatType  `json:"type" db:"type"`
+	Name        *string   `json:"name,omitempty" db:"name"`
+	Description *string   `json:"description,omitempty" db:"description"`
+	AvatarURL   *string   `json:"avatar_url,omitempty" db:"avatar_url"`
+	AuthorID    *int      `json:"author_id,omitempty" db:"author_id"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
 }
 
 type ChatMember struct {
+	ID       int             `json:"id" db:"id"`
+	Nickname string          `json:"nickname" db:"nickname"`
+	Role     GroupMemberRole `json:"role" db:"role"`
+	IsOnline bool            `json:"is_online"`
+
+	// nil while hidden by the member's privacy settings
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty" db:"last_seen_at"`
+
+	OnlinePrivacy   PrivacyLevel `json:"-" db:"online_privacy"`
+	LastSeenPrivacy PrivacyLevel `json:"-" db:"last_seen_privacy"`
+	// whether the viewer of the list is a contact of the member
+	IsContact bool `json:"-" db:"is_contact"`
+}
+
+type UserProfile struct {
 	ID       int    `json:"id" db:"id"`
 	Nickname string `json:"nickname" db:"nickname"`
-	IsOnline bool   `json:"is_online"`
+	// only returned to the user themselves
+	Email       string  `json:"email,omitempty" db:"email"`
+	About       *string `json:"about,omitempty" db:"about"`
+	Experience  *string `json:"experience,omitempty" db:"experience"`
+	GithubURL   *string `json:"github_url,omitempty" db:"github_url"`
+	LinkedinURL *string `json:"linkedin_url,omitempty" db:"linkedin_url"`
+	TwitterURL  *string `json:"twitter_url,omitempty" db:"twitter_url"`
+	TelegramURL *string `json:"telegram_url,omitempty" db:"telegram_url"`
+	WebsiteURL  *string `json:"website_url,omitempty" db:"website_url"`
+	// only returned to the user themselves
+	Discoverable *bool `json:"discoverable,omitempty" db:"discoverable"`
+	// nil while hidden by the user's privacy settings
+	LastSeenAt      *time.Time   `json:"last_seen_at,omitempty" db:"last_seen_at"`
+	LastSeenPrivacy PrivacyLevel `json:"-" db:"privacy_last_seen"`
+	// nil when not set, expired or hidden by the online status privacy setting
+	Status              *UserStatus  `json:"status,omitempty" db:"-"`
+	OnlineStatusPrivacy PrivacyLevel `json:"-" db:"privacy_online_status"`
+	// only returned to the user themselves
+	DND       *DNDSettings `json:"dnd,omitempty" db:"-"`
+	CreatedAt time.Time    `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at" db:"updated_at"`
+}
+
+type PrivacySettings struct {
+	OnlineStatus PrivacyLevel `json:"online_status" db:"privacy_online_status"`
+	LastSeen     PrivacyLevel `json:"last_seen" db:"privacy_last_seen"`
+	// who may add the user to group chats
+	GroupInvites PrivacyLevel `json:"group_invites" db:"privacy_group_invites"`
+	// who may start a private chat with the user
+	PrivateChats PrivacyLevel `json:"private_chats" db:"privacy_private_chats"`
+}
+
+// What a viewer may learn about a user's presence
+type PresenceVisibility struct {
+	UserID          int          `db:"user_id"`
+	OnlinePrivacy   PrivacyLevel `db:"online_privacy"`
+	LastSeenPrivacy PrivacyLevel `db:"last_seen_privacy"`
+	LastSeenAt      *time.Time   `db:"last_seen_at"`
+	IsContact       bool         `db:"is_contact"`
+	// the user blocked the viewer
+	BlockedViewer bool `db:"blocked_viewer"`
+	UserStatus
+}
+
+type UserSummary struct {
+	ID       int    `json:"id" db:"id"`
+	Nickname string `json:"nickname" db:"nickname"`
+}
+
+type ContactRequest struct {
+	FromUserID   int       `json:"from_user_id" db:"from_user_id"`
+	FromNickname string    `json:"from_nickname" db:"from_nickname"`
+	ToUserID     int       `json:"to_user_id" db:"to_user_id"`
+	ToNickname   string    `json:"to_nickname" db:"to_nickname"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
 }
 
 type (
@@ -33,6 +104,8 @@ type (
 	GroupMemberRole string
 
 	EventType string
+
+	PrivacyLevel string
 )
 
 const (
@@ -43,6 +116,10 @@ const (
 	StatusDelivered MessageStatus = "DELIVERED"
 	StatusRead      MessageStatus = "READ"
 
+	PrivacyEveryone PrivacyLevel = "everyone"
+	PrivacyContacts PrivacyLevel = "contacts"
+	PrivacyNobody   PrivacyLevel = "nobody"
+
 	MemberRole GroupMemberRole = "MEMBER"
 	AdminRole  GroupMemberRole = "ADMIN"
 
@@ -59,9 +136,60 @@ const (
 	NewMemberType    EventType = "new_member"
 	LeftMemberType   EventType = "left_member"
 	KickedMemberType EventType = "kicked_member"
+	// members added together with the group, content holds their ids as a JSON array
+	MembersAddedType EventType = "members_added"
+
+	// system messages, content is the new value
+	ChatRenamedType            EventType = "chat_renamed"
+	ChatDescriptionChangedType EventType = "chat_description_changed"
+	ChatAvatarChangedType      EventType = "chat_avatar_changed"
+	ChatUpdatedType            EventType = "chat_updated"
 
 	InvitedToGroupChatType   EventType = "INVITED_TO_CHAT"
 	DeletedFromGroupChatType EventType = "DELETED_FROM_CHAT"
 
 	PresenceChangeType EventType = "PRESENCE_CHANGE"
+
+	ErrorType EventType = "error"
+
+	ProfileUpdatedType EventType = "profile_updated"
+
+	PresenceSubscribeType   EventType = "presence_subscribe"
+	PresenceUnsubscribeType EventType = "presence_unsubscribe"
+	PresenceSnapshotType    EventType = "presence_snapshot"
+
+	ReauthType          EventType = "reauth"
+	ReauthenticatedType EventType = "reauthenticated"
+	TokenExpiringType   EventType = "token_expiring"
+
+	ContactRequestType          EventType = "contact_request"
+	ContactRequestAcceptedType  EventType = "contact_request_accepted"
+	ContactRequestDeclinedType  EventType = "contact_request_declined"
+	ContactRequestCancelledType EventType = "contact_request_cancelled"
+	ContactRemovedType          EventType = "contact_removed"
 )
+
+// Ephemeral events may be dropped for slow consumers without forcing them to resync
+func (t EventType) IsEphemeral() bool {
+	switch t {
+	case PresenceChangeType:
+		return true
+	}
+	return false
+}
+
+func (p PrivacyLevel) Valid() bool {
+	return p == PrivacyEveryone || p == PrivacyContacts || p == PrivacyNobody
+}
+
+// Allows reports whether someone may see or do what p guards, given whether they are a contact.
+func (p PrivacyLevel) Allows(isContact bool) bool {
+	switch p {
+	case PrivacyEveryone:
+		return true
+	case PrivacyContacts:
+		return isContact
+	default:
+		return false
+	}
+}
@@ -0,0 +1,100 @@
+package domain
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type UserStatus struct {
+	Text  string `json:"text,omitempty" db:"status_text"`
+	Emoji string `json:"emoji,omitempty" db:"status_emoji"`
+	// the status is cleared after this
+	ExpiresAt *time.Time `json:"expires_at,omitempty" db:"status_expires_at"`
+}
+
+// IsSet reports whether the status has content and has not expired at now.
+func (s *UserStatus) IsSet(now time.Time) bool {
+	if s.Text == "" && s.Emoji == "" {
+		return false
+	}
+	return s.ExpiresAt == nil || now.Before(*s.ExpiresAt)
+}
+
+// Do not disturb, either until a moment or every day between ScheduleStart and ScheduleEnd in Timezone.
+type DNDSettings struct {
+	Until         *time.Time `json:"until,omitempty" db:"dnd_until"`
+	ScheduleStart *ClockTime `json:"schedule_start,omitempty" db:"dnd_schedule_start"`
+	ScheduleEnd   *ClockTime `json:"schedule_end,omitempty" db:"dnd_schedule_end"`
+	Timezone      *string    `json:"timezone,omitempty" db:"dnd_timezone"`
+
+	// computed when returned to the user
+	Active bool `json:"active" db:"-"`
+}
+
+// IsActive reports whether notifications should be held back at now. The schedule may wrap past midnight.
+func (d *DNDSettings) IsActive(now time.Time) bool {
+	if d.Until != nil && now.Before(*d.Until) {
+		return true
+	}
+	if d.ScheduleStart == nil || d.ScheduleEnd == nil || d.Timezone == nil {
+		return false
+	}
+
+	loc, err := time.LoadLocation(*d.Timezone)
+	if err != nil {
+		return false
+	}
+	local := now.In(loc)
+	current := ClockTime(local.Hour()*60 + local.Minute())
+
+	start, end := *d.ScheduleStart, *d.ScheduleEnd
+	if start <= end {
+		return current >= start && current < end
+	}
+	return current >= start || current < end
+}
+
+// Minutes since midnight, "HH:MM" in JSON
+type ClockTime int
+
+func ParseClockTime(s string) (ClockTime, error) {
+	invalid := fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	if len(s) != 5 || s[2] != ':' {
+		return 0, invalid
+	}
+	for _, i := range []int{0, 1, 3, 4} {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, invalid
+		}
+	}
+
+	h := int(s[0]-'0')*10 + int(s[1]-'0')
+	m := int(s[3]-'0')*10 + int(s[4]-'0')
+	if h > 23 || m > 59 {
+		return 0, invalid
+	}
+	return ClockTime(h*60 + m), nil
+}
+
+func (c ClockTime) String() string {
+	return fmt.Sprintf("%02d:%02d", int(c)/60, int(c)%60)
+}
+
+func (c ClockTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+func (c *ClockTime) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	parsed, err := ParseClockTime(s)
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
@@ -0,0 +1,127 @@
+package domain
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseClockTime(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ClockTime
+		wantErr bool
+	}{
+		{in: "00:00", want: 0},
+		{in: "09:30", want: 9*60 + 30},
+		{in: "23:59", want: 23*60 + 59},
+		{in: "24:00", wantErr: true},
+		{in: "12:60", wantErr: true},
+		{in: "9:30", wantErr: true},
+		{in: "09:30:00", wantErr: true},
+		{in: "+1:00", wantErr: true},
+		{in: " 1:00", wantErr: true},
+		{in: "-1:00", wantErr: true},
+		{in: "ab:cd", wantErr: true},
+		{in: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseClockTime(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseClockTime(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParseClockTime(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClockTimeJSON(t *testing.T) {
+	for _, c := range []ClockTime{0, 7*60 + 5, 23*60 + 59} {
+		data, err := json.Marshal(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got ClockTime
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", data, err)
+		}
+		if got != c {
+			t.Errorf("round trip of %d through %s gave %d", c, data, got)
+		}
+	}
+
+	data, _ := json.Marshal(ClockTime(7*60 + 5))
+	if string(data) != `"07:05"` {
+		t.Errorf("Marshal = %s, want \"07:05\"", data)
+	}
+
+	for _, bad := range []string{`"7:5"`, `425`, `"25:00"`, `"07-05"`} {
+		var c ClockTime
+		if err := json.Unmarshal([]byte(bad), &c); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded with %d", bad, c)
+		}
+	}
+}
+
+func TestDNDSettingsIsActive(t *testing.T) {
+	clock := func(s string) *ClockTime {
+		c, err := ParseClockTime(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &c
+	}
+	tz := func(name string) *string { return &name }
+	at := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	until := at("2026-10-18T12:00:00Z")
+
+	tests := []struct {
+		name string
+		dnd  DNDSettings
+		now  string
+		want bool
+	}{
+		{"nothing set", DNDSettings{}, "2026-10-18T10:00:00Z", false},
+		{"before until", DNDSettings{Until: &until}, "2026-10-18T11:59:00Z", true},
+		{"after until", DNDSettings{Until: &until}, "2026-10-18T12:00:00Z", false},
+
+		{"same day, inside", DNDSettings{ScheduleStart: clock("09:00"), ScheduleEnd: clock("17:00"), Timezone: tz("UTC")}, "2026-10-18T09:00:00Z", true},
+		{"same day, end is exclusive", DNDSettings{ScheduleStart: clock("09:00"), ScheduleEnd: clock("17:00"), Timezone: tz("UTC")}, "2026-10-18T17:00:00Z", false},
+		{"same day, before", DNDSettings{ScheduleStart: clock("09:00"), ScheduleEnd: clock("17:00"), Timezone: tz("UTC")}, "2026-10-18T08:59:00Z", false},
+
+		{"across midnight, late evening", DNDSettings{ScheduleStart: clock("22:00"), ScheduleEnd: clock("07:00"), Timezone: tz("UTC")}, "2026-10-18T23:30:00Z", true},
+		{"across midnight, early morning", DNDSettings{ScheduleStart: clock("22:00"), ScheduleEnd: clock("07:00"), Timezone: tz("UTC")}, "2026-10-19T06:59:00Z", true},
+		{"across midnight, daytime", DNDSettings{ScheduleStart: clock("22:00"), ScheduleEnd: clock("07:00"), Timezone: tz("UTC")}, "2026-10-18T12:00:00Z", false},
+		{"across midnight, end is exclusive", DNDSettings{ScheduleStart: clock("22:00"), ScheduleEnd: clock("07:00"), Timezone: tz("UTC")}, "2026-10-19T07:00:00Z", false},
+
+		// 20:00 UTC is 23:00 in Moscow (UTC+3)
+		{"timezone ahead of utc", DNDSettings{ScheduleStart: clock("22:00"), ScheduleEnd: clock("07:00"), Timezone: tz("Europe/Moscow")}, "2026-10-18T20:00:00Z", true},
+		// 03:00 UTC is 23:00 the day before in New York (UTC-4 in October)
+		{"timezone behind utc", DNDSettings{ScheduleStart: clock("22:00"), ScheduleEnd: clock("07:00"), Timezone: tz("America/New_York")}, "2026-10-19T03:00:00Z", true},
+		// 12:00 UTC is 08:00 in New York
+		{"timezone behind utc, outside", DNDSettings{ScheduleStart: clock("22:00"), ScheduleEnd: clock("07:00"), Timezone: tz("America/New_York")}, "2026-10-18T12:00:00Z", false},
+
+		{"schedule without timezone", DNDSettings{ScheduleStart: clock("00:00"), ScheduleEnd: clock("23:59")}, "2026-10-18T12:00:00Z", false},
+		{"unknown timezone", DNDSettings{ScheduleStart: clock("00:00"), ScheduleEnd: clock("23:59"), Timezone: tz("Mars/Olympus")}, "2026-10-18T12:00:00Z", false},
+		{"until wins over schedule", DNDSettings{Until: &until, ScheduleStart: clock("22:00"), ScheduleEnd: clock("07:00"), Timezone: tz("UTC")}, "2026-10-18T11:00:00Z", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.dnd.IsActive(at(tt.now)); got != tt.want {
+				t.Errorf("IsActive(%s) = %v, want %v", tt.now, got, tt.want)
+			}
+		})
+	}
+}
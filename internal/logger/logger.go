@@ -0,0 +1,83 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/ReilBleem13/MessangerV2/internal/config"
+)
+
+const redacted = "[REDACTED]"
+
+// attribute keys that carry user written text, keep in sync with the list on config.Log.LogContent.
+// Anything user written must be logged under one of these keys.
+var contentKeys = map[string]struct{}{
+	"content":     {},
+	"new_content": {},
+	"text":        {},
+	"status_text": {},
+	"emoji":       {},
+	"about":       {},
+	"bio":         {},
+	"description": {},
+	"name":        {},
+	"nickname":    {},
+	"query":       {},
+}
+
+type contextKey struct{}
+
+// Setup replaces the default logger according to cfg.
+func Setup(cfg config.Log) error {
+	handler, err := newHandler(os.Stdout, cfg)
+	if err != nil {
+		return err
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+func newHandler(w io.Writer, cfg config.Log) (slog.Handler, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", cfg.Level, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	if !cfg.LogContent {
+		opts.ReplaceAttr = redactContent
+	}
+
+	switch cfg.Format {
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q, expected json or text", cfg.Format)
+	}
+}
+
+func redactContent(_ []string, a slog.Attr) slog.Attr {
+	if _, ok := contentKeys[a.Key]; ok {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+// With returns a context whose logger has args attached.
+func With(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, contextKey{}, FromContext(ctx).With(args...))
+}
+
+// FromContext returns the logger attached with With or the default one.
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "messenger"
+
+// websocket connections
+var (
+	WSConnectionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ws_connections_active",
+		Help:      "Currently open websocket connections.",
+	})
+
+	WSConnectionsOpened = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_connections_opened_total",
+		Help:      "Websocket connections accepted.",
+	})
+
+	// reason: client_closed, abnormal_close, timeout, network_error, resync_required, going_away,
+	// token_expired, session_revoked, error
+	WSConnectionsClosed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_connections_closed_total",
+		Help:      "Websocket connections closed by reason.",
+	}, []string{"reason"})
+
+	// type is limited to known frame types, everything else is counted as unknown
+	FramesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ws_frames_received_total",
+		Help:      "Websocket frames received by type.",
+	}, []string{"type"})
+)
+
+// outbound queues
+var (
+	SendQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "send_queue_depth",
+		Help:      "Events waiting in outbound queues of all connections.",
+	})
+
+	SendQueueDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "send_queue_dropped_total",
+		Help:      "Ephemeral events dropped for slow consumers.",
+	})
+
+	SendQueueOverflows = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "send_queue_overflows_total",
+		Help:      "Connections closed because their outbound queue overflowed.",
+	})
+)
+
+// messaging pipeline
+var (
+	// measured against the client clock, so skewed clients show up as outliers
+	MessageSendLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "message_send_latency_seconds",
+		Help:      "Time from client_send_at of a message to its confirmation.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	})
+
+	FanOutSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "fanout_recipients",
+		Help:      "Recipients of a single broadcast event.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	})
+
+	ProduceFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "produce_failures_total",
+		Help:      "Events that could not be handed to the hub.",
+	})
+
+	PubSubLag = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "pubsub_lag_seconds",
+		Help:      "Time between publishing a node envelope and receiving it on the target node.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+	})
+)
+
+// storage
+var (
+	DBQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Postgres query duration by repository method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	// result: hit or miss
+	MemberCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "member_cache_requests_total",
+		Help:      "Chat member cache lookups by result.",
+	}, []string{"result"})
+
+	// scope: frame type for websocket frames, http_user or http_ip for API requests
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests and frames rejected by rate limits.",
+	}, []string{"scope"})
+)
+
+func ObserveQuery(method string, start time.Time) {
+	DBQueryDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,138 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/lib/pq"
+)
+
+// BlockUser is idempotent, blocking an already blocked user is not an error.
+// The users stop being contacts and pending contact requests between them are dropped.
+func (ur *UserRepo) BlockUser(ctx context.Context, blockerID, blockedID int) error {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "BlockUser")
+	defer done()
+
+	query := `
+		WITH removed_contacts AS (
+			DELETE FROM contacts
+			WHERE (user_id = $1 AND contact_id = $2)
+				OR (user_id = $2 AND contact_id = $1)
+		), removed_requests AS (
+			DELETE FROM contact_requests
+			WHERE (from_user_id = $1 AND to_user_id = $2)
+				OR (from_user_id = $2 AND to_user_id = $1)
+		)
+		INSERT INTO user_blocks (blocker_id, blocked_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`
+
+	_, err := ur.db.ExecContext(ctx, query,
+		blockerID,
+		blockedID,
+	)
+	if err != nil {
+		var pgErr *pq.Error
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+			return domain.ErrNotFound.WithMessage("User not found")
+		}
+		return err
+	}
+	return nil
+}
+
+func (ur *UserRepo) UnblockUser(ctx context.Context, blockerID, blockedID int) error {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "UnblockUser")
+	defer done()
+
+	query := `
+		DELETE FROM user_blocks
+		WHERE blocker_id = $1 AND blocked_id = $2
+	`
+
+	_, err := ur.db.ExecContext(ctx, query,
+		blockerID,
+		blockedID,
+	)
+	return err
+}
+
+func (ur *UserRepo) IsBlocked(ctx context.Context, blockerID, blockedID int) (bool, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "IsBlocked")
+	defer done()
+
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM user_blocks
+			WHERE blocker_id = $1 AND blocked_id = $2
+		)
+	`
+
+	var blocked bool
+	err := ur.db.GetContext(ctx, &blocked, query,
+		blockerID,
+		blockedID,
+	)
+	return blocked, err
+}
+
+// IsBlockedInPrivateChat reports whether the other member of a private chat blocked userID.
+// Always false for group chats.
+func (ur *UserRepo) IsBlockedInPrivateChat(ctx context.Context, chatID, userID int) (bool, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "IsBlockedInPrivateChat")
+	defer done()
+
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM chats c
+			JOIN chat_members cm ON cm.chat_id = c.id
+			JOIN user_blocks ub ON ub.blocker_id = cm.user_id
+			WHERE c.id = $1
+				AND c.type = $2
+				AND ub.blocked_id = $3
+		)
+	`
+
+	var blocked bool
+	err := ur.db.GetContext(ctx, &blocked, query,
+		chatID,
+		domain.Private,
+		userID,
+	)
+	return blocked, err
+}
+
+// GetBlockedUserIDs returns the users blocked by each of blockerIDs, blockers without blocks are absent.
+func (ur *UserRepo) GetBlockedUserIDs(ctx context.Context, blockerIDs []int) (map[int][]int, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "GetBlockedUserIDs")
+	defer done()
+
+	result := make(map[int][]int, len(blockerIDs))
+	if len(blockerIDs) == 0 {
+		return result, nil
+	}
+
+	query := `
+		SELECT blocker_id, blocked_id
+		FROM user_blocks
+		WHERE blocker_id = ANY($1)
+	`
+
+	var rows []struct {
+		BlockerID int `db:"blocker_id"`
+		BlockedID int `db:"blocked_id"`
+	}
+	err := ur.db.SelectContext(ctx, &rows, query, pq.Array(blockerIDs))
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		result[row.BlockerID] = append(result[row.BlockerID], row.BlockedID)
+	}
+	return result, nil
+}
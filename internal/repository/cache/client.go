@@ -1,13 +1,17 @@
 package cache
 
-import "github.com/redis/go-redis/v9"
+import (
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+)
 
 var client *redis.Client
 
-func NewRedisClient(addr string) {
+func NewRedisClient(addr string) error {
 	client = redis.NewClient(&redis.Options{
 		Addr: addr,
 	})
+	return redisotel.InstrumentTracing(client)
 }
 
 func Client() *redis.Client {
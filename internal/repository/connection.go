@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/ReilBleem13/MessangerV2/internal/service"
@@ -22,64 +21,83 @@ func NewConnectionRepo(redis *redis.Client) *ConnectionRepo {
 	}
 }
 
-func (cr *ConnectionRepo) Subscribe(ctx context.Context, userID int) *redis.PubSub {
-	channel := fmt.Sprintf("message:%d", userID)
-	return cr.redis.Subscribe(ctx, channel)
+func nodeChannel(nodeID string) string {
+	return "node:" + nodeID
 }
 
-func (cr *ConnectionRepo) Produce(ctx context.Context, channel string, msg *service.ProduceMessage) error {
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("failed to marshal message: %w", err)
+func (cr *ConnectionRepo) SubscribeNode(ctx context.Context, nodeID string) *redis.PubSub {
+	return cr.redis.Subscribe(ctx, nodeChannel(nodeID))
+}
+
+// PublishToNodes sends one envelope per node in a single pipeline.
+func (cr *ConnectionRepo) PublishToNodes(ctx context.Context, envelopes map[string]*service.NodeEnvelope) error {
+	if len(envelopes) == 0 {
+		return nil
 	}
-	return cr.redis.Publish(ctx, channel, data).Err()
+
+	pipe := cr.redis.Pipeline()
+	for nodeID, envelope := range envelopes {
+		data, err := json.Marshal(envelope)
+		if err != nil {
+			return fmt.Errorf("failed to marshal envelope: %w", err)
+		}
+		pipe.Publish(ctx, nodeChannel(nodeID), data)
+	}
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// A user may be connected to several nodes at once. Nodes are kept in a sorted set scored
+// with the expiry of each node's mapping, so a node that died without cleaning up drops out
+// on its own.
+func userNodesKey(userID int) string {
+	return fmt.Sprintf("user:nodes:%d", userID)
 }
 
-func (cr *ConnectionRepo) UpdateOnlineStatus(ctx context.Context, in *service.PresenceEvent) error {
-	key := fmt.Sprintf("user:online:%d", in.UserID)
-	return cr.redis.Set(ctx, key, in.Timestamp, 3*24*time.Hour).Err()
+func (cr *ConnectionRepo) SetUserNode(ctx context.Context, userID int, nodeID string, ttl time.Duration) error {
+	key := userNodesKey(userID)
+	now := time.Now()
+
+	_, err := cr.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.UnixMilli(), 10))
+		pipe.ZAdd(ctx, key, redis.Z{Score: float64(now.Add(ttl).UnixMilli()), Member: nodeID})
+		pipe.PExpire(ctx, key, ttl)
+		return nil
+	})
+	return err
 }
 
-func (cr *ConnectionRepo) GetOnlineStatus(ctx context.Context, userID int) (time.Time, error) {
-	key := fmt.Sprintf("user:online:%d", userID)
-	return cr.redis.Get(ctx, key).Time()
+// DeleteUserNode removes nodeID only, the user's connections on other nodes stay registered.
+func (cr *ConnectionRepo) DeleteUserNode(ctx context.Context, userID int, nodeID string) error {
+	return cr.redis.ZRem(ctx, userNodesKey(userID), nodeID).Err()
 }
 
-func (cr *ConnectionRepo) GetAllOnlineUsers(ctx context.Context) ([]service.OnlineUsersWithLastTimestamp, error) {
-	result := []service.OnlineUsersWithLastTimestamp{}
-	var cursor uint64
+// GetUserNodes returns the nodes every connected user is attached to.
+// Users that are not connected anywhere are absent from the result.
+func (cr *ConnectionRepo) GetUserNodes(ctx context.Context, userIDs []int) (map[int][]string, error) {
+	result := make(map[int][]string, len(userIDs))
+	if len(userIDs) == 0 {
+		return result, nil
+	}
 
-	for {
-		keys, nextCursor, err := cr.redis.Scan(ctx, cursor, "user:online:*", 1000).Result()
-		if err != nil {
-			return nil, err
-		}
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	cmds := make([]*redis.StringSliceCmd, len(userIDs))
 
-		for _, key := range keys {
-			userIDStr := strings.TrimPrefix(key, "user:online:")
-			userID, err := strconv.Atoi(userIDStr)
-			if err != nil {
-				continue
-			}
-
-			timestamp, err := cr.redis.Get(ctx, key).Time()
-			if err == nil {
-				result = append(result, service.OnlineUsersWithLastTimestamp{
-					UserID:     userID,
-					Timestampt: timestamp,
-				})
-			}
+	_, err := cr.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, userID := range userIDs {
+			cmds[i] = pipe.ZRangeByScore(ctx, userNodesKey(userID), &redis.ZRangeBy{Min: "(" + now, Max: "+inf"})
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		cursor = nextCursor
-		if cursor == 0 {
-			break
+	for i, cmd := range cmds {
+		if nodes := cmd.Val(); len(nodes) > 0 {
+			result[userIDs[i]] = nodes
 		}
 	}
 	return result, nil
 }
-
-func (cr *ConnectionRepo) DeleteOnlineStatus(ctx context.Context, userID int) error {
-	key := fmt.Sprintf("user:online:%d", userID)
-	return cr.redis.Del(ctx, key).Err()
-}
@@ -0,0 +1,174 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/lib/pq"
+)
+
+// contactRequestColumns expects the request as req
+const contactRequestColumns = `
+	req.from_user_id,
+	fu.nickname AS from_nickname,
+	req.to_user_id,
+	tu.nickname AS to_nickname,
+	req.created_at
+`
+
+func (ur *UserRepo) GetContacts(ctx context.Context, userID int) ([]domain.UserSummary, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "GetContacts")
+	defer done()
+
+	query := `
+		SELECT
+			u.id,
+			u.nickname
+		FROM contacts c
+		JOIN users u ON u.id = c.contact_id
+		WHERE c.user_id = $1
+		ORDER BY lower(u.nickname), u.id
+	`
+
+	var contacts []domain.UserSummary
+	if err := ur.db.SelectContext(ctx, &contacts, query, userID); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return contacts, nil
+}
+
+// RemoveContact removes the users from each other's contacts, false if they weren't contacts.
+func (ur *UserRepo) RemoveContact(ctx context.Context, userID, contactID int) (bool, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "RemoveContact")
+	defer done()
+
+	query := `
+		DELETE FROM contacts
+		WHERE (user_id = $1 AND contact_id = $2)
+			OR (user_id = $2 AND contact_id = $1)
+	`
+
+	res, err := ur.db.ExecContext(ctx, query,
+		userID,
+		contactID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// GetContactRequests returns the pending requests sent and received by the user, newest first.
+func (ur *UserRepo) GetContactRequests(ctx context.Context, userID int) ([]domain.ContactRequest, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "GetContactRequests")
+	defer done()
+
+	query := `
+		SELECT ` + contactRequestColumns + `
+		FROM contact_requests req
+		JOIN users fu ON fu.id = req.from_user_id
+		JOIN users tu ON tu.id = req.to_user_id
+		WHERE req.from_user_id = $1 OR req.to_user_id = $1
+		ORDER BY req.created_at DESC
+	`
+
+	var requests []domain.ContactRequest
+	if err := ur.db.SelectContext(ctx, &requests, query, userID); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// CreateContactRequest is idempotent, a repeated request keeps its original time.
+func (ur *UserRepo) CreateContactRequest(ctx context.Context, fromID, toID int) (*domain.ContactRequest, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "CreateContactRequest")
+	defer done()
+
+	query := `
+		WITH req AS (
+			INSERT INTO contact_requests (from_user_id, to_user_id)
+			VALUES ($1, $2)
+			ON CONFLICT (from_user_id, to_user_id) DO UPDATE
+				SET created_at = contact_requests.created_at
+			RETURNING from_user_id, to_user_id, created_at
+		)
+		SELECT ` + contactRequestColumns + `
+		FROM req
+		JOIN users fu ON fu.id = req.from_user_id
+		JOIN users tu ON tu.id = req.to_user_id
+	`
+
+	var request domain.ContactRequest
+	if err := ur.db.GetContext(ctx, &request, query, fromID, toID); err != nil {
+		var pgErr *pq.Error
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+			return nil, domain.ErrNotFound.WithMessage("User not found")
+		}
+		return nil, err
+	}
+	return &request, nil
+}
+
+// AcceptContactRequest deletes the request and makes the users contacts of each other.
+func (ur *UserRepo) AcceptContactRequest(ctx context.Context, fromID, toID int) (*domain.ContactRequest, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "AcceptContactRequest")
+	defer done()
+
+	query := `
+		WITH req AS (
+			DELETE FROM contact_requests
+			WHERE from_user_id = $1 AND to_user_id = $2
+			RETURNING from_user_id, to_user_id, created_at
+		), added AS (
+			INSERT INTO contacts (user_id, contact_id)
+			SELECT from_user_id, to_user_id FROM req
+			UNION ALL
+			SELECT to_user_id, from_user_id FROM req
+			ON CONFLICT DO NOTHING
+		)
+		SELECT ` + contactRequestColumns + `
+		FROM req
+		JOIN users fu ON fu.id = req.from_user_id
+		JOIN users tu ON tu.id = req.to_user_id
+	`
+
+	return ur.getContactRequest(ctx, query, fromID, toID)
+}
+
+// DeleteContactRequest is used both to decline and to cancel a request.
+func (ur *UserRepo) DeleteContactRequest(ctx context.Context, fromID, toID int) (*domain.ContactRequest, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "DeleteContactRequest")
+	defer done()
+
+	query := `
+		WITH req AS (
+			DELETE FROM contact_requests
+			WHERE from_user_id = $1 AND to_user_id = $2
+			RETURNING from_user_id, to_user_id, created_at
+		)
+		SELECT ` + contactRequestColumns + `
+		FROM req
+		JOIN users fu ON fu.id = req.from_user_id
+		JOIN users tu ON tu.id = req.to_user_id
+	`
+
+	return ur.getContactRequest(ctx, query, fromID, toID)
+}
+
+func (ur *UserRepo) getContactRequest(ctx context.Context, query string, fromID, toID int) (*domain.ContactRequest, error) {
+	var request domain.ContactRequest
+	if err := ur.db.GetContext(ctx, &request, query, fromID, toID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, domain.ErrNotFound.WithMessage("Contact request not found")
+		}
+		return nil, err
+	}
+	return &request, nil
+}
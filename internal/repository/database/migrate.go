@@ -0,0 +1,64 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/pressly/goose/v3"
+)
+
+var MigrationsDir = filepath.Join("internal", "repository", "database", "migrations")
+
+// Dialect has to be set with goose.SetDialect before running migrations
+const Dialect = "postgres"
+
+// goose's default version table
+const versionTable = "goose_db_version"
+
+// ExpectedSchemaVersion is the version of the newest migration shipped with the binary.
+// Migrations are read once, readiness probes check the version on every call.
+var ExpectedSchemaVersion = sync.OnceValues(func() (int64, error) {
+	migrations, err := goose.CollectMigrations(MigrationsDir, 0, goose.MaxVersion)
+	if err != nil {
+		return 0, err
+	}
+
+	last, err := migrations.Last()
+	if err != nil {
+		return 0, err
+	}
+	return last.Version, nil
+})
+
+// CheckSchemaVersion fails if the database is behind the expected version. A newer schema is fine:
+// during a rolling deploy old nodes keep running after the new release has migrated the database.
+func CheckSchemaVersion(ctx context.Context, db *sql.DB) error {
+	expected, err := ExpectedSchemaVersion()
+	if err != nil {
+		return fmt.Errorf("collect migrations: %w", err)
+	}
+
+	current, err := SchemaVersion(ctx, db)
+	if err != nil {
+		return fmt.Errorf("get schema version: %w", err)
+	}
+
+	if current < expected {
+		return fmt.Errorf("schema version is %d, expected at least %d, run `migrate up`", current, expected)
+	}
+	return nil
+}
+
+// SchemaVersion only reads the version table. Unlike goose.GetDBVersion it never creates the table
+// and touches no goose globals, so readiness probes can call it concurrently.
+func SchemaVersion(ctx context.Context, db *sql.DB) (int64, error) {
+	var version int64
+	query := `SELECT COALESCE(MAX(version_id), 0) FROM ` + versionTable
+	if err := db.QueryRowContext(ctx, query).Scan(&version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
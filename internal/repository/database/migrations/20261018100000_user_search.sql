@@ -0,0 +1,20 @@
+-- +goose Up
+
+-- needs CREATE privilege on the database, or the extension installed beforehand
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+ALTER TABLE users ADD COLUMN discoverable BOOLEAN NOT NULL DEFAULT TRUE;
+
+--------------------------------------------------------------------------------
+
+CREATE INDEX idx_users_nickname_lower      ON users (lower(nickname) text_pattern_ops);
+CREATE INDEX idx_users_nickname_lower_trgm ON users USING GIN (lower(nickname) gin_trgm_ops);
+
+--------------------------------------------------------------------------------
+
+-- +goose Down
+
+DROP INDEX IF EXISTS idx_users_nickname_lower_trgm;
+DROP INDEX IF EXISTS idx_users_nickname_lower;
+
+ALTER TABLE users DROP COLUMN IF EXISTS discoverable;
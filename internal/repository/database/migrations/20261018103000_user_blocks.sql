@@ -0,0 +1,21 @@
+-- +goose Up
+
+CREATE TABLE user_blocks (
+    blocker_id  INT REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+    blocked_id  INT REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+    created_at  TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (blocker_id, blocked_id),
+    CHECK (blocker_id != blocked_id)
+);
+
+--------------------------------------------------------------------------------
+
+CREATE INDEX idx_user_blocks_blocked_id ON user_blocks (blocked_id);
+
+--------------------------------------------------------------------------------
+
+-- +goose Down
+
+DROP INDEX IF EXISTS idx_user_blocks_blocked_id;
+
+DROP TABLE IF EXISTS user_blocks;
@@ -0,0 +1,17 @@
+-- +goose Up
+
+CREATE TYPE privacy_level AS ENUM ('everyone', 'contacts', 'nobody');
+
+ALTER TABLE users
+    ADD COLUMN privacy_online_status privacy_level NOT NULL DEFAULT 'everyone',
+    ADD COLUMN privacy_last_seen     privacy_level NOT NULL DEFAULT 'everyone',
+    ADD COLUMN privacy_group_invites privacy_level NOT NULL DEFAULT 'everyone';
+
+-- +goose Down
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS privacy_group_invites,
+    DROP COLUMN IF EXISTS privacy_last_seen,
+    DROP COLUMN IF EXISTS privacy_online_status;
+
+DROP TYPE IF EXISTS privacy_level;
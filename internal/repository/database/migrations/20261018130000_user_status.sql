@@ -0,0 +1,26 @@
+-- +goose Up
+
+ALTER TABLE users
+    ADD COLUMN status_text        VARCHAR(100) NOT NULL DEFAULT '',
+    ADD COLUMN status_emoji       VARCHAR(32)  NOT NULL DEFAULT '',
+    ADD COLUMN status_expires_at  TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN dnd_until          TIMESTAMP WITH TIME ZONE,
+    -- minutes since midnight in dnd_timezone
+    ADD COLUMN dnd_schedule_start SMALLINT,
+    ADD COLUMN dnd_schedule_end   SMALLINT,
+    ADD COLUMN dnd_timezone       VARCHAR(64);
+
+CREATE INDEX idx_users_status_expires_at ON users (status_expires_at) WHERE status_expires_at IS NOT NULL;
+
+-- +goose Down
+
+DROP INDEX IF EXISTS idx_users_status_expires_at;
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS dnd_timezone,
+    DROP COLUMN IF EXISTS dnd_schedule_end,
+    DROP COLUMN IF EXISTS dnd_schedule_start,
+    DROP COLUMN IF EXISTS dnd_until,
+    DROP COLUMN IF EXISTS status_expires_at,
+    DROP COLUMN IF EXISTS status_emoji,
+    DROP COLUMN IF EXISTS status_text;
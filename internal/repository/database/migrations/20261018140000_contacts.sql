@@ -0,0 +1,43 @@
+-- +goose Up
+
+-- stored in both directions
+CREATE TABLE contacts (
+    user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    contact_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, contact_id),
+    CHECK (user_id <> contact_id)
+);
+
+-- pending only, accepting, declining or cancelling deletes the row
+CREATE TABLE contact_requests (
+    from_user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    to_user_id   INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (from_user_id, to_user_id),
+    CHECK (from_user_id <> to_user_id)
+);
+
+CREATE INDEX idx_contact_requests_to_user_id ON contact_requests (to_user_id);
+
+-- contacts used to be derived from private chats, keep those users as contacts
+INSERT INTO contacts (user_id, contact_id)
+SELECT DISTINCT cm1.user_id, cm2.user_id
+FROM chats c
+JOIN chat_members cm1 ON cm1.chat_id = c.id
+JOIN chat_members cm2 ON cm2.chat_id = c.id
+WHERE c.type = 'PRIVATE'
+    AND cm1.user_id <> cm2.user_id
+ON CONFLICT DO NOTHING;
+
+-- who may start a private chat with the user
+ALTER TABLE users
+    ADD COLUMN privacy_private_chats privacy_level NOT NULL DEFAULT 'everyone';
+
+-- +goose Down
+
+ALTER TABLE users
+    DROP COLUMN IF EXISTS privacy_private_chats;
+
+DROP TABLE IF EXISTS contact_requests;
+DROP TABLE IF EXISTS contacts;
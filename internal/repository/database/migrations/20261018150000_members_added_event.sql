@@ -0,0 +1,11 @@
+-- +goose NO TRANSACTION
+
+-- +goose Up
+
+-- one system message for the members added when a group is created
+ALTER TYPE chat_event_type ADD VALUE IF NOT EXISTS 'members_added';
+
+-- +goose Down
+
+-- enum values can't be dropped, only the messages using it
+DELETE FROM messages WHERE event_type = 'members_added';
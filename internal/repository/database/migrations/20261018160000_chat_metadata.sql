@@ -0,0 +1,21 @@
+-- +goose NO TRANSACTION
+
+-- +goose Up
+
+ALTER TABLE chats
+    ADD COLUMN IF NOT EXISTS description VARCHAR(500),
+    ADD COLUMN IF NOT EXISTS avatar_url  VARCHAR(500);
+
+-- content of these system messages is the new value
+ALTER TYPE chat_event_type ADD VALUE IF NOT EXISTS 'chat_renamed';
+ALTER TYPE chat_event_type ADD VALUE IF NOT EXISTS 'chat_description_changed';
+ALTER TYPE chat_event_type ADD VALUE IF NOT EXISTS 'chat_avatar_changed';
+
+-- +goose Down
+
+-- enum values can't be dropped, only the messages using them
+DELETE FROM messages WHERE event_type IN ('chat_renamed', 'chat_description_changed', 'chat_avatar_changed');
+
+ALTER TABLE chats
+    DROP COLUMN IF EXISTS avatar_url,
+    DROP COLUMN IF EXISTS description;
@@ -0,0 +1,12 @@
+-- +goose Up
+
+-- uploaded files live in the database so every node can serve them
+CREATE TABLE IF NOT EXISTS uploads (
+    name       VARCHAR(64) PRIMARY KEY,
+    data       BYTEA       NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- +goose Down
+
+DROP TABLE IF EXISTS uploads;
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// FileStore keeps uploads in Postgres, shared by every node, and hands out urls under urlPrefix.
+type FileStore struct {
+	db        *sqlx.DB
+	urlPrefix string
+}
+
+func NewFileStore(db *sqlx.DB, urlPrefix string) *FileStore {
+	return &FileStore{
+		db:        db,
+		urlPrefix: urlPrefix,
+	}
+}
+
+type Upload struct {
+	Name      string    `db:"name"`
+	Data      []byte    `db:"data"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// Save stores data under a random name, uploads are never overwritten so they can be cached forever.
+func (st *FileStore) Save(ctx context.Context, data []byte, ext string) (string, error) {
+	ctx, done := instrumentRepo(ctx, "FileStore", "Save")
+	defer done()
+
+	name := uuid.NewString() + ext
+
+	query := `INSERT INTO uploads (name, data) VALUES ($1, $2)`
+	if _, err := st.db.ExecContext(ctx, query, name, data); err != nil {
+		return "", err
+	}
+	return st.urlPrefix + name, nil
+}
+
+// Get returns the upload called name, domain.ErrNotFound if there is none.
+func (st *FileStore) Get(ctx context.Context, name string) (*Upload, error) {
+	ctx, done := instrumentRepo(ctx, "FileStore", "Get")
+	defer done()
+
+	var upload Upload
+	query := `SELECT name, data, created_at FROM uploads WHERE name = $1`
+	if err := st.db.GetContext(ctx, &upload, query, name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, domain.ErrNotFound.WithMessage("File not found")
+		}
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// Delete ignores urls that don't belong to the store and files that are already gone.
+func (st *FileStore) Delete(ctx context.Context, url string) error {
+	ctx, done := instrumentRepo(ctx, "FileStore", "Delete")
+	defer done()
+
+	name, ok := strings.CutPrefix(url, st.urlPrefix)
+	if !ok || name == "" {
+		return nil
+	}
+
+	_, err := st.db.ExecContext(ctx, `DELETE FROM uploads WHERE name = $1`, name)
+	return err
+}
@@ -0,0 +1,28 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/ReilBleem13/MessangerV2/internal/metrics"
+	"github.com/ReilBleem13/MessangerV2/internal/tracing"
+)
+
+// instrument wraps a MessageRepo method with a span and a query duration observation:
+//
+//	ctx, done := instrument(ctx, "NewMessage")
+//	defer done()
+func instrument(ctx context.Context, method string) (context.Context, func()) {
+	return instrumentRepo(ctx, "MessageRepo", method)
+}
+
+// instrumentRepo is instrument for other repositories, method names must stay unique across them.
+func instrumentRepo(ctx context.Context, repo, method string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, repo+"."+method)
+
+	return ctx, func() {
+		metrics.ObserveQuery(method, start)
+		span.End()
+	}
+}
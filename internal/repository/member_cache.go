@@ -0,0 +1,150 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ReilBleem13/MessangerV2/internal/logger"
+	"github.com/ReilBleem13/MessangerV2/internal/metrics"
+	"github.com/ReilBleem13/MessangerV2/internal/tracing"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Membership rarely changes while messages are fanned out constantly, so member ids are kept
+// in a Redis set per chat. Every membership mutation bumps the chat's version and drops the set.
+// A refill only lands if the version is still the one read before querying Postgres, so a reader
+// that loaded the members before a mutation committed can't put the old list back.
+const memberCacheTTL = 10 * time.Minute
+
+// outlives any refill in flight, refreshed on every bump
+const memberVersionTTL = 24 * time.Hour
+
+// stored alone in the set of a chat without members, it never parses as a user id
+const emptyMembersSentinel = "-"
+
+// invalidation runs after the transaction committed, it is retried rather than failing the request
+const memberInvalidateAttempts = 3
+
+func memberCacheKey(chatID int) string {
+	return fmt.Sprintf("chat:members:%d", chatID)
+}
+
+func memberVersionKey(chatID int) string {
+	return fmt.Sprintf("chat:members:version:%d", chatID)
+}
+
+// refills KEYS[1] with ARGV[3:] only if the version in KEYS[2] still equals ARGV[1] ("" if it was unset)
+var refillMembersScript = redis.NewScript(`
+	local version = redis.call("GET", KEYS[2]) or ""
+	if version ~= ARGV[1] then
+		return 0
+	end
+	redis.call("DEL", KEYS[1])
+	redis.call("SADD", KEYS[1], unpack(ARGV, 3))
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+`)
+
+func (mp *MessageRepo) GetChatMemberIDs(ctx context.Context, chatID int) ([]int, error) {
+	ctx, span := tracing.Start(ctx, "MessageRepo.GetChatMemberIDs")
+	defer span.End()
+
+	key := memberCacheKey(chatID)
+
+	cached, err := mp.cache.SMembers(ctx, key).Result()
+	if err == nil && len(cached) > 0 {
+		memberIDs := make([]int, 0, len(cached))
+		for _, idStr := range cached {
+			// skips the empty chat sentinel
+			id, err := strconv.Atoi(idStr)
+			if err != nil {
+				continue
+			}
+			memberIDs = append(memberIDs, id)
+		}
+
+		metrics.MemberCacheRequests.WithLabelValues("hit").Inc()
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+		return memberIDs, nil
+	}
+	if err != nil {
+		logger.FromContext(ctx).Warn("Failed to read chat members from cache", "chat_id", chatID, "error", err)
+	}
+
+	metrics.MemberCacheRequests.WithLabelValues("miss").Inc()
+	span.SetAttributes(attribute.Bool("cache.hit", false))
+
+	// read before Postgres, a mutation committed after this bumps it and the refill is skipped
+	version, err := mp.cache.Get(ctx, memberVersionKey(chatID)).Result()
+	canRefill := err == nil || err == redis.Nil
+	if !canRefill {
+		logger.FromContext(ctx).Warn("Failed to read chat members version", "chat_id", chatID, "error", err)
+	}
+
+	query := `
+		SELECT user_id
+		FROM chat_members
+		WHERE chat_id = $1
+	`
+
+	start := time.Now()
+
+	var memberIDs []int
+	err = mp.db.SelectContext(ctx, &memberIDs, query,
+		chatID,
+	)
+	metrics.ObserveQuery("GetChatMemberIDs", start)
+	if err != nil {
+		return nil, err
+	}
+
+	if !canRefill {
+		return memberIDs, nil
+	}
+
+	args := make([]any, 0, len(memberIDs)+3)
+	args = append(args, version, memberCacheTTL.Milliseconds())
+	if len(memberIDs) == 0 {
+		args = append(args, emptyMembersSentinel)
+	}
+	for _, id := range memberIDs {
+		args = append(args, id)
+	}
+
+	keys := []string{key, memberVersionKey(chatID)}
+	if err := refillMembersScript.Run(ctx, mp.cache, keys, args...).Err(); err != nil {
+		logger.FromContext(ctx).Warn("Failed to fill chat members cache", "chat_id", chatID, "error", err)
+	}
+	return memberIDs, nil
+}
+
+// invalidateChatMembers must be called after the membership change committed.
+func (mp *MessageRepo) invalidateChatMembers(ctx context.Context, chatID int) {
+	// the change is already committed, a cancelled request must not leave the cache stale
+	ctx = context.WithoutCancel(ctx)
+	versionKey := memberVersionKey(chatID)
+
+	var err error
+	for attempt := range memberInvalidateAttempts {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 50 * time.Millisecond)
+		}
+
+		_, err = mp.cache.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Incr(ctx, versionKey)
+			pipe.Expire(ctx, versionKey, memberVersionTTL)
+			pipe.Del(ctx, memberCacheKey(chatID))
+			return nil
+		})
+		if err == nil {
+			return
+		}
+	}
+	logger.FromContext(ctx).Error("Failed to invalidate chat members cache, members may be stale until it expires",
+		"chat_id", chatID,
+		"error", err,
+	)
+}
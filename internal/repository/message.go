@@ -3,8 +3,10 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/ReilBleem13/MessangerV2/internal/domain"
 	"github.com/ReilBleem13/MessangerV2/internal/service"
@@ -27,6 +29,9 @@ func NewMessageRepo(db *sqlx.DB, cache *redis.Client) *MessageRepo {
 
 // To add messages from private chats and group chats.
 func (mp *MessageRepo) NewMessage(ctx context.Context, in *domain.Message) (int, error) {
+	ctx, done := instrument(ctx, "NewMessage")
+	defer done()
+
 	tx, err := mp.db.BeginTxx(ctx, &sql.TxOptions{})
 	if err != nil {
 		return 0, err
@@ -88,6 +93,9 @@ func (mp *MessageRepo) NewMessage(ctx context.Context, in *domain.Message) (int,
 }
 
 func (mp *MessageRepo) EditMessage(ctx context.Context, messageID int, content string) error {
+	ctx, done := instrument(ctx, "EditMessage")
+	defer done()
+
 	query := `
 		UPDATE messages
 		SET content = $1, updated_at = NOW()
@@ -102,6 +110,9 @@ func (mp *MessageRepo) EditMessage(ctx context.Context, messageID int, content s
 }
 
 func (mp *MessageRepo) DeleteMessage(ctx context.Context, messageID int) error {
+	ctx, done := instrument(ctx, "DeleteMessage")
+	defer done()
+
 	query := `
 		DETELE FROM messages
 		WHERE id = $1
@@ -114,6 +125,9 @@ func (mp *MessageRepo) DeleteMessage(ctx context.Context, messageID int) error {
 }
 
 func (mp *MessageRepo) GetMessageAuthorID(ctx context.Context, messageID int) (int, error) {
+	ctx, done := instrument(ctx, "GetMessageAuthorID")
+	defer done()
+
 	query := `
 		SELECT from_user_id
 		FROM messages
@@ -129,10 +143,15 @@ func (mp *MessageRepo) GetMessageAuthorID(ctx context.Context, messageID int) (i
 	return userID, nil
 }
 
-func (mp *MessageRepo) NewGroupChat(ctx context.Context, name string, authorID int) (int, error) {
+// NewGroupChat creates the chat with the author as admin and memberIDs as members. When memberIDs is
+// not empty a single members_added message is stored and its id returned.
+func (mp *MessageRepo) NewGroupChat(ctx context.Context, name string, authorID int, memberIDs []int) (int, int, error) {
+	ctx, done := instrument(ctx, "NewGroupChat")
+	defer done()
+
 	tx, err := mp.db.BeginTxx(ctx, &sql.TxOptions{})
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 	defer tx.Rollback()
 
@@ -149,7 +168,7 @@ func (mp *MessageRepo) NewGroupChat(ctx context.Context, name string, authorID i
 		authorID,
 	).Scan(&groupID)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
 	query = `
@@ -163,41 +182,234 @@ func (mp *MessageRepo) NewGroupChat(ctx context.Context, name string, authorID i
 		string(domain.AdminRole),
 	)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
+	}
+
+	var messageID int
+	if len(memberIDs) > 0 {
+		messageID, err = mp.addInitialGroupMembers(ctx, tx, groupID, authorID, memberIDs)
+		if err != nil {
+			return 0, 0, err
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return groupID, messageID, err
+}
+
+func (mp *MessageRepo) addInitialGroupMembers(ctx context.Context, tx *sqlx.Tx, groupID, authorID int, memberIDs []int) (int, error) {
+	ids := make(pq.Int64Array, len(memberIDs))
+	for i, userID := range memberIDs {
+		ids[i] = int64(userID)
+	}
+
+	query := `
+		INSERT INTO chat_members (chat_id, user_id)
+		SELECT $1, unnest($2::INTEGER[])
+		ON CONFLICT DO NOTHING;
+	`
+
+	_, err := tx.ExecContext(ctx, query,
+		groupID,
+		ids,
+	)
+	if err != nil {
+		var pgErr *pq.Error
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+			return 0, domain.ErrNotFound.WithMessage("User not found")
+		}
+		return 0, err
+	}
+
+	content, err := json.Marshal(memberIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	message, err := mp.newSystemMessage(ctx, tx, groupID, authorID, domain.MembersAddedType, string(content))
+	if err != nil {
 		return 0, err
 	}
-	return groupID, err
+	return message.ID, nil
 }
 
-func (mp *MessageRepo) DeleteGroupChat(ctx context.Context, chatID, authorID int) error {
+// newSystemMessage stores an event message of userID, sent to every current member of the chat.
+func (mp *MessageRepo) newSystemMessage(ctx context.Context, tx *sqlx.Tx, chatID, userID int,
+	eventType domain.EventType, content string) (*domain.Message, error) {
 	query := `
-		DELETE FROM chats 
-		WHERE id = $1 AND author_id = $2;
+		INSERT INTO messages (chat_id, from_user_id, content, event_type)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at;
 	`
 
-	res, err := mp.db.ExecContext(ctx, query,
+	message := domain.Message{
+		ChatID:      chatID,
+		FromUserID:  userID,
+		MessageType: eventType,
+		Content:     content,
+	}
+	err := tx.QueryRowContext(ctx, query,
+		chatID,
+		userID,
+		content,
+		string(eventType),
+	).Scan(&message.ID, &message.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		INSERT INTO message_status (message_id, user_id, status)
+		SELECT $1, user_id, $2
+		FROM chat_members
+		WHERE chat_id = $3;
+	`
+
+	_, err = tx.ExecContext(ctx, query,
+		message.ID,
+		string(domain.StatusSent),
 		chatID,
-		authorID,
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &message, nil
+}
+
+const groupChatColumns = `
+	id,
+	type,
+	name,
+	description,
+	avatar_url,
+	author_id,
+	created_at
+`
+
+// UpdateGroupChat applies the fields of the dto that differ from the stored ones, empty description and
+// avatar are stored as NULL. A system message is stored per changed field.
+func (mp *MessageRepo) UpdateGroupChat(ctx context.Context, in *service.UpdateGroupChatDTO) (*service.UpdatedGroupChat, error) {
+	ctx, done := instrument(ctx, "UpdateGroupChat")
+	defer done()
 
-	rowsAff, err := res.RowsAffected()
+	tx, err := mp.db.BeginTxx(ctx, &sql.TxOptions{})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer tx.Rollback()
 
-	if rowsAff == 0 {
-		return fmt.Errorf("user %d is not author of %d group chat", authorID, chatID)
+	query := `SELECT ` + groupChatColumns + ` FROM chats WHERE id = $1 AND type = $2 FOR UPDATE`
+
+	var chat domain.UserChat
+	if err := tx.GetContext(ctx, &chat, query, in.ChatID, string(domain.Group)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, domain.ErrNotFound.WithMessage("Group chat not found")
+		}
+		return nil, err
 	}
-	return nil
+
+	type change struct {
+		column    string
+		eventType domain.EventType
+		value     string
+	}
+
+	var changes []change
+	changed := func(column string, eventType domain.EventType, current, value *string) {
+		if value != nil && *value != derefString(current) {
+			changes = append(changes, change{column: column, eventType: eventType, value: *value})
+		}
+	}
+	changed("name", domain.ChatRenamedType, chat.Name, in.Name)
+	changed("description", domain.ChatDescriptionChangedType, chat.Description, in.Description)
+	changed("avatar_url", domain.ChatAvatarChangedType, chat.AvatarURL, in.AvatarURL)
+
+	result := &service.UpdatedGroupChat{
+		Chat: &chat,
+	}
+	if len(changes) == 0 {
+		return result, tx.Commit()
+	}
+
+	var (
+		sets []string
+		args []any
+	)
+	for _, c := range changes {
+		args = append(args, sql.NullString{String: c.value, Valid: c.value != ""})
+		sets = append(sets, fmt.Sprintf("%s = $%d", c.column, len(args)))
+
+		if c.column == "avatar_url" {
+			result.OldAvatarURL = chat.AvatarURL
+		}
+	}
+	sets = append(sets, "updated_at = NOW()")
+
+	args = append(args, in.ChatID)
+	query = fmt.Sprintf(`
+		UPDATE chats
+		SET %s
+		WHERE id = $%d
+		RETURNING `+groupChatColumns,
+		strings.Join(sets, ", "), len(args),
+	)
+
+	var updated domain.UserChat
+	if err := tx.GetContext(ctx, &updated, query, args...); err != nil {
+		return nil, err
+	}
+	result.Chat = &updated
+
+	for _, c := range changes {
+		message, err := mp.newSystemMessage(ctx, tx, in.ChatID, in.UserID, c.eventType, c.value)
+		if err != nil {
+			return nil, err
+		}
+		result.Messages = append(result.Messages, *message)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// DeleteGroupChat returns the avatar url of the deleted chat, the file is left to the caller.
+func (mp *MessageRepo) DeleteGroupChat(ctx context.Context, chatID, authorID int) (*string, error) {
+	ctx, done := instrument(ctx, "DeleteGroupChat")
+	defer done()
+
+	query := `
+		DELETE FROM chats 
+		WHERE id = $1 AND author_id = $2
+		RETURNING avatar_url;
+	`
+
+	var avatarURL *string
+	if err := mp.db.QueryRowxContext(ctx, query, chatID, authorID).Scan(&avatarURL); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("user %d is not author of %d group chat", authorID, chatID)
+		}
+		return nil, err
+	}
+
+	mp.invalidateChatMembers(ctx, chatID)
+	return avatarURL, nil
 }
 
 func (mp *MessageRepo) NewGroupChatMember(ctx context.Context, chatID, userID int) (int, error) {
+	ctx, done := instrument(ctx, "NewGroupChatMember")
+	defer done()
+
 	tx, err := mp.db.BeginTxx(ctx, &sql.TxOptions{})
 	if err != nil {
 		return 0, err
@@ -262,11 +474,16 @@ func (mp *MessageRepo) NewGroupChatMember(ctx context.Context, chatID, userID in
 	if err := tx.Commit(); err != nil {
 		return 0, err
 	}
+
+	mp.invalidateChatMembers(ctx, chatID)
 	return messageID, nil
 }
 
 // typeDelete => LeftMemberType или KickedMemberType
 func (mp *MessageRepo) DeleteGroupMember(ctx context.Context, chatID, userID int, typeDelete domain.EventType) (int, error) {
+	ctx, done := instrument(ctx, "DeleteGroupMember")
+	defer done()
+
 	tx, err := mp.db.BeginTxx(ctx, &sql.TxOptions{})
 	if err != nil {
 		return 0, err
@@ -327,10 +544,15 @@ func (mp *MessageRepo) DeleteGroupMember(ctx context.Context, chatID, userID int
 	if err := tx.Commit(); err != nil {
 		return 0, err
 	}
+
+	mp.invalidateChatMembers(ctx, chatID)
 	return messageID, nil
 }
 
 func (mp *MessageRepo) GetAllChatMembers(ctx context.Context, chatID int) ([]*domain.ChatMember, error) {
+	ctx, done := instrument(ctx, "GetAllChatMembers")
+	defer done()
+
 	return mp.getAllChatMembersWithExecutor(ctx, mp.db, chatID)
 }
 
@@ -338,7 +560,8 @@ func (mp *MessageRepo) getAllChatMembersWithExecutor(ctx context.Context, execut
 	query := `
 		SELECT 
 			cm.user_id AS id,
-			u.nickname
+			u.nickname,
+			cm.role
 		FROM chat_members cm
 		JOIN users u ON cm.user_id = u.id
 		WHERE cm.chat_id = $1
@@ -354,7 +577,100 @@ func (mp *MessageRepo) getAllChatMembersWithExecutor(ctx context.Context, execut
 	return chatMembers, nil
 }
 
+func (mp *MessageRepo) PaginateChatMembers(ctx context.Context, in *service.PaginateChatMembersDTO) ([]*domain.ChatMember, *int, bool, error) {
+	ctx, done := instrument(ctx, "PaginateChatMembers")
+	defer done()
+
+	query := `
+		SELECT 
+			cm.user_id AS id,
+			u.nickname,
+			cm.role,
+			u.last_seen_at,
+			u.privacy_online_status AS online_privacy,
+			u.privacy_last_seen AS last_seen_privacy,
+			EXISTS (
+				SELECT 1 FROM contacts ct
+				WHERE ct.user_id = cm.user_id AND ct.contact_id = $6
+			) AS is_contact
+		FROM chat_members cm
+		JOIN users u ON cm.user_id = u.id
+		WHERE cm.chat_id = $1
+			AND ($2::INTEGER IS NULL OR cm.user_id > $2)
+			AND ($3::TEXT IS NULL OR lower(u.nickname) LIKE $3 ESCAPE '\')
+			AND ($4::TEXT IS NULL OR cm.role = $4)
+		ORDER BY cm.user_id
+		LIMIT $5
+	`
+
+	var nicknamePattern *string
+	if in.Query != nil {
+		pattern := escapeLike(strings.ToLower(*in.Query)) + "%"
+		nicknamePattern = &pattern
+	}
+
+	var role *string
+	if in.Role != nil {
+		r := string(*in.Role)
+		role = &r
+	}
+
+	var members []*domain.ChatMember
+	err := mp.db.SelectContext(ctx, &members, query,
+		in.ChatID,
+		in.Cursor,
+		nicknamePattern,
+		role,
+		in.Limit+1,
+		in.UserID,
+	)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, false, err
+	}
+
+	hasMore := len(members) > in.Limit
+	if hasMore {
+		members = members[:in.Limit]
+	}
+
+	var nextCursor *int
+	if hasMore {
+		lastID := members[len(members)-1].ID
+		nextCursor = &lastID
+	}
+	return members, nextCursor, hasMore, nil
+}
+
+func (mp *MessageRepo) HasPrivateChat(ctx context.Context, userID1, userID2 int) (bool, error) {
+	ctx, done := instrument(ctx, "HasPrivateChat")
+	defer done()
+
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM chats c
+			JOIN chat_members cm1 ON cm1.chat_id = c.id
+			JOIN chat_members cm2 ON cm2.chat_id = c.id
+			WHERE c.type = $1
+				AND cm1.user_id = $2
+				AND cm2.user_id = $3
+				AND cm1.user_id != cm2.user_id
+		)
+	`
+
+	var exists bool
+	err := mp.db.GetContext(ctx, &exists, query,
+		string(domain.Private),
+		userID1,
+		userID2,
+	)
+	return exists, err
+}
+
 func (mp *MessageRepo) GetOrCreatePrivateChat(ctx context.Context, userID1, userID2 int) (int, bool, error) {
+	ctx, done := instrument(ctx, "GetOrCreatePrivateChat")
+	defer done()
+
 	tx, err := mp.db.BeginTxx(ctx, &sql.TxOptions{})
 	if err != nil {
 		return 0, false, err
@@ -419,15 +735,22 @@ func (mp *MessageRepo) GetOrCreatePrivateChat(ctx context.Context, userID1, user
 	if err := tx.Commit(); err != nil {
 		return 0, false, err
 	}
+
+	mp.invalidateChatMembers(ctx, chatID)
 	return chatID, true, nil
 }
 
 func (mp *MessageRepo) GetUserChats(ctx context.Context, userID int) ([]domain.UserChat, error) {
+	ctx, done := instrument(ctx, "GetUserChats")
+	defer done()
+
 	query := `
 		SELECT 
 			c.id,
 			c.type, 
 			c.name, 
+			c.description,
+			c.avatar_url,
 			c.author_id, 
 			c.created_at
 		FROM chats c
@@ -447,6 +770,9 @@ func (mp *MessageRepo) GetUserChats(ctx context.Context, userID int) ([]domain.U
 }
 
 func (mp *MessageRepo) GetGroupChatMemberRole(ctx context.Context, userID, chatID int) (domain.GroupMemberRole, error) {
+	ctx, done := instrument(ctx, "GetGroupChatMemberRole")
+	defer done()
+
 	query := `
 		SELECT 
 			role
@@ -467,6 +793,9 @@ func (mp *MessageRepo) GetGroupChatMemberRole(ctx context.Context, userID, chatI
 }
 
 func (mp *MessageRepo) ChangeGroupChatMemberRole(ctx context.Context, in *service.UpdateGroupMemberRoleDTO) error {
+	ctx, done := instrument(ctx, "ChangeGroupChatMemberRole")
+	defer done()
+
 	query := `
 		UPDATE chat_members 
 			SET role = $1
@@ -482,6 +811,9 @@ func (mp *MessageRepo) ChangeGroupChatMemberRole(ctx context.Context, in *servic
 }
 
 func (mp *MessageRepo) GetAllUndeliveredMessages(ctx context.Context, userID int) ([]domain.Message, error) {
+	ctx, done := instrument(ctx, "GetAllUndeliveredMessages")
+	defer done()
+
 	query := `
 		SELECT 
 			m.id,
@@ -507,6 +839,9 @@ func (mp *MessageRepo) GetAllUndeliveredMessages(ctx context.Context, userID int
 }
 
 func (mp *MessageRepo) PaginateMessages(ctx context.Context, chatID int, cursor *int) ([]domain.Message, *int, bool, error) {
+	ctx, done := instrument(ctx, "PaginateMessages")
+	defer done()
+
 	query := `
 		SELECT 
 			id,
@@ -545,6 +880,9 @@ func (mp *MessageRepo) PaginateMessages(ctx context.Context, chatID int, cursor
 }
 
 func (mp *MessageRepo) SetDeliveredAtStatus(ctx context.Context, messageID, userID int) error {
+	ctx, done := instrument(ctx, "SetDeliveredAtStatus")
+	defer done()
+
 	query := `
 		UPDATE message_status
 			SET status = 'DELIVERED', delivered_at = NOW()
@@ -563,6 +901,9 @@ func (mp *MessageRepo) SetDeliveredAtStatus(ctx context.Context, messageID, user
 }
 
 func (mp *MessageRepo) SetReadAtStatus(ctx context.Context, upToID, chatID, userID int) error {
+	ctx, done := instrument(ctx, "SetReadAtStatus")
+	defer done()
+
 	query := `
 		UPDATE message_status ms
 		SET status = 'READ', read_at = NOW()
@@ -583,20 +924,17 @@ func (mp *MessageRepo) SetReadAtStatus(ctx context.Context, upToID, chatID, user
 }
 
 func (mp *MessageRepo) GetUserContacts(ctx context.Context, userID int) ([]int, error) {
+	ctx, done := instrument(ctx, "GetUserContacts")
+	defer done()
+
 	query := `
-		SELECT 
-			cm2.user_id
-		FROM chats c
-		JOIN chat_members cm ON cm.chat_id = c.id
-		JOIN chat_members cm2 ON cm2.chat_id = c.id
-		WHERE c.type = $1
-			AND cm.user_id = $2
-			AND cm2.user_id != $2
+		SELECT contact_id
+		FROM contacts
+		WHERE user_id = $1
 	`
 
 	var contacts []int
 	err := mp.db.SelectContext(ctx, &contacts, query,
-		domain.Private,
 		userID,
 	)
 	if err != nil && err != sql.ErrNoRows {
@@ -604,3 +942,40 @@ func (mp *MessageRepo) GetUserContacts(ctx context.Context, userID int) ([]int,
 	}
 	return contacts, nil
 }
+
+// GetContactsOfUsers returns the contacts of each of userIDs, users without contacts are absent.
+func (mp *MessageRepo) GetContactsOfUsers(ctx context.Context, userIDs []int) (map[int][]int, error) {
+	ctx, done := instrument(ctx, "GetContactsOfUsers")
+	defer done()
+
+	result := make(map[int][]int, len(userIDs))
+	if len(userIDs) == 0 {
+		return result, nil
+	}
+
+	query := `
+		SELECT user_id, contact_id
+		FROM contacts
+		WHERE user_id = ANY($1)
+	`
+
+	var rows []struct {
+		UserID    int `db:"user_id"`
+		ContactID int `db:"contact_id"`
+	}
+	err := mp.db.SelectContext(ctx, &rows, query, pq.Array(userIDs))
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		result[row.UserID] = append(result[row.UserID], row.ContactID)
+	}
+	return result, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
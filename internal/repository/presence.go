@@ -0,0 +1,244 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ReilBleem13/MessangerV2/internal/service"
+	"github.com/redis/go-redis/v9"
+)
+
+// Online users scored by their last heartbeat in unix milliseconds.
+const presenceKey = "presence:online"
+
+func (cr *ConnectionRepo) UpdateOnlineStatus(ctx context.Context, in *service.PresenceEvent) error {
+	return cr.redis.ZAdd(ctx, presenceKey, redis.Z{
+		Score:  float64(in.Timestamp.UnixMilli()),
+		Member: in.UserID,
+	}).Err()
+}
+
+// GetOnlineStatus returns the last heartbeat of the user, redis.Nil if they are offline.
+func (cr *ConnectionRepo) GetOnlineStatus(ctx context.Context, userID int) (time.Time, error) {
+	score, err := cr.redis.ZScore(ctx, presenceKey, strconv.Itoa(userID)).Result()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(int64(score)), nil
+}
+
+// GetOnlineStatuses resolves last heartbeat timestamps for several users with one ZMSCORE.
+// Offline users are absent from the result.
+func (cr *ConnectionRepo) GetOnlineStatuses(ctx context.Context, userIDs []int) (map[int]time.Time, error) {
+	result := make(map[int]time.Time, len(userIDs))
+	if len(userIDs) == 0 {
+		return result, nil
+	}
+
+	members := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		members[i] = strconv.Itoa(userID)
+	}
+
+	scores, err := cr.redis.ZMScore(ctx, presenceKey, members...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, score := range scores {
+		// missing members come back as 0
+		if score == 0 {
+			continue
+		}
+		result[userIDs[i]] = time.UnixMilli(int64(score))
+	}
+	return result, nil
+}
+
+// GetExpiredOnlineUsers returns up to limit users whose last heartbeat is older than before.
+func (cr *ConnectionRepo) GetExpiredOnlineUsers(ctx context.Context, before time.Time, limit int) ([]service.OnlineUsersWithLastTimestamp, error) {
+	entries, err := cr.redis.ZRangeByScoreWithScores(ctx, presenceKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   "(" + strconv.FormatInt(before.UnixMilli(), 10),
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]service.OnlineUsersWithLastTimestamp, 0, len(entries))
+	for _, entry := range entries {
+		userID, err := strconv.Atoi(entry.Member.(string))
+		if err != nil {
+			continue
+		}
+		result = append(result, service.OnlineUsersWithLastTimestamp{
+			UserID:     userID,
+			Timestampt: time.UnixMilli(int64(entry.Score)),
+		})
+	}
+	return result, nil
+}
+
+// removes members whose score is still below ARGV[1], a heartbeat since the scan keeps them online
+var removeExpiredScript = redis.NewScript(`
+	local removed = {}
+	for i = 2, #ARGV do
+		local score = redis.call("ZSCORE", KEYS[1], ARGV[i])
+		if score and tonumber(score) < tonumber(ARGV[1]) then
+			redis.call("ZREM", KEYS[1], ARGV[i])
+			table.insert(removed, ARGV[i])
+		end
+	end
+	return removed
+`)
+
+// RemoveExpiredOnlineUsers removes the users that still haven't sent a heartbeat since before
+// and returns the ones removed.
+func (cr *ConnectionRepo) RemoveExpiredOnlineUsers(ctx context.Context, userIDs []int, before time.Time) ([]int, error) {
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	args := make([]any, 0, len(userIDs)+1)
+	args = append(args, before.UnixMilli())
+	for _, userID := range userIDs {
+		args = append(args, userID)
+	}
+
+	members, err := removeExpiredScript.Run(ctx, cr.redis, []string{presenceKey}, args...).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	removed := make([]int, 0, len(members))
+	for _, member := range members {
+		userID, err := strconv.Atoi(member)
+		if err != nil {
+			continue
+		}
+		removed = append(removed, userID)
+	}
+	return removed, nil
+}
+
+// Subscribers are stored per connection as "{user_id}:{conn_id}" so one connection
+// unsubscribing or going away doesn't affect the user's other connections.
+func presenceSubscribersKey(targetID int) string {
+	return fmt.Sprintf("presence:subscribers:%d", targetID)
+}
+
+// refreshed on every subscribe, drops members left behind by a node that died
+const presenceSubscribersTTL = 24 * time.Hour
+
+func (cr *ConnectionRepo) AddPresenceSubscriptions(ctx context.Context, userID int, connID string, targetIDs []int) error {
+	member := fmt.Sprintf("%d:%s", userID, connID)
+
+	_, err := cr.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, targetID := range targetIDs {
+			key := presenceSubscribersKey(targetID)
+			pipe.SAdd(ctx, key, member)
+			pipe.Expire(ctx, key, presenceSubscribersTTL)
+		}
+		return nil
+	})
+	return err
+}
+
+func (cr *ConnectionRepo) RemovePresenceSubscriptions(ctx context.Context, userID int, connID string, targetIDs []int) error {
+	if len(targetIDs) == 0 {
+		return nil
+	}
+	member := fmt.Sprintf("%d:%s", userID, connID)
+
+	_, err := cr.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, targetID := range targetIDs {
+			pipe.SRem(ctx, presenceSubscribersKey(targetID), member)
+		}
+		return nil
+	})
+	return err
+}
+
+// GetPresenceSubscribers returns, per target, the users with at least one connection subscribed to it.
+// Targets without subscribers are absent from the result.
+func (cr *ConnectionRepo) GetPresenceSubscribers(ctx context.Context, targetIDs []int) (map[int][]int, error) {
+	result := make(map[int][]int, len(targetIDs))
+	if len(targetIDs) == 0 {
+		return result, nil
+	}
+
+	cmds := make([]*redis.StringSliceCmd, len(targetIDs))
+	_, err := cr.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, targetID := range targetIDs {
+			cmds[i] = pipe.SMembers(ctx, presenceSubscribersKey(targetID))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, cmd := range cmds {
+		members := cmd.Val()
+		if len(members) == 0 {
+			continue
+		}
+
+		seen := make(map[int]struct{}, len(members))
+		subscribers := make([]int, 0, len(members))
+		for _, member := range members {
+			userIDStr, _, _ := strings.Cut(member, ":")
+			userID, err := strconv.Atoi(userIDStr)
+			if err != nil {
+				continue
+			}
+			if _, ok := seen[userID]; ok {
+				continue
+			}
+			seen[userID] = struct{}{}
+			subscribers = append(subscribers, userID)
+		}
+		result[targetIDs[i]] = subscribers
+	}
+	return result, nil
+}
+
+// renews the lease if owner already holds it, takes it if it is free
+var acquireLeaseScript = redis.NewScript(`
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	end
+	if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+		return 1
+	end
+	return 0
+`)
+
+// AcquireLease makes owner the holder of the named lease for ttl, it reports false if another owner holds it.
+func (cr *ConnectionRepo) AcquireLease(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	acquired, err := acquireLeaseScript.Run(ctx, cr.redis, []string{"lease:" + name},
+		owner,
+		ttl.Milliseconds(),
+	).Int()
+	if err != nil {
+		return false, err
+	}
+	return acquired == 1, nil
+}
+
+// deletes KEYS[1] only if it still holds ARGV[1]
+var compareAndDeleteScript = redis.NewScript(`
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		return redis.call("DEL", KEYS[1])
+	end
+	return 0
+`)
+
+// ReleaseLease gives the lease up if owner still holds it.
+func (cr *ConnectionRepo) ReleaseLease(ctx context.Context, name, owner string) error {
+	return compareAndDeleteScript.Run(ctx, cr.redis, []string{"lease:" + name}, owner).Err()
+}
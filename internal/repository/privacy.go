@@ -0,0 +1,170 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/ReilBleem13/MessangerV2/internal/service"
+	"github.com/lib/pq"
+)
+
+const privacyColumns = `
+	privacy_online_status,
+	privacy_last_seen,
+	privacy_group_invites,
+	privacy_private_chats
+`
+
+func (ur *UserRepo) GetPrivacySettings(ctx context.Context, userID int) (*domain.PrivacySettings, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "GetPrivacySettings")
+	defer done()
+
+	query := `SELECT ` + privacyColumns + ` FROM users WHERE id = $1`
+
+	var settings domain.PrivacySettings
+	if err := ur.db.GetContext(ctx, &settings, query, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, domain.ErrNotFound.WithMessage("User not found")
+		}
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// GetPrivacySettingsForUsers loads settings of many users in one query, unknown ids are absent from the result.
+func (ur *UserRepo) GetPrivacySettingsForUsers(ctx context.Context, userIDs []int) (map[int]*domain.PrivacySettings, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "GetPrivacySettingsForUsers")
+	defer done()
+
+	result := make(map[int]*domain.PrivacySettings, len(userIDs))
+	if len(userIDs) == 0 {
+		return result, nil
+	}
+
+	query := `SELECT id, ` + privacyColumns + ` FROM users WHERE id = ANY($1)`
+
+	var rows []struct {
+		ID int `db:"id"`
+		domain.PrivacySettings
+	}
+	if err := ur.db.SelectContext(ctx, &rows, query, pq.Array(userIDs)); err != nil {
+		return nil, err
+	}
+
+	for i := range rows {
+		result[rows[i].ID] = &rows[i].PrivacySettings
+	}
+	return result, nil
+}
+
+func (ur *UserRepo) UpdatePrivacySettings(ctx context.Context, userID int, in *service.UpdatePrivacyDTO) (*domain.PrivacySettings, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "UpdatePrivacySettings")
+	defer done()
+
+	var (
+		sets []string
+		args []any
+	)
+	set := func(column string, value *domain.PrivacyLevel) {
+		if value == nil {
+			return
+		}
+		args = append(args, string(*value))
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+
+	set("privacy_online_status", in.OnlineStatus)
+	set("privacy_last_seen", in.LastSeen)
+	set("privacy_group_invites", in.GroupInvites)
+	set("privacy_private_chats", in.PrivateChats)
+	sets = append(sets, "updated_at = NOW()")
+
+	args = append(args, userID)
+	query := fmt.Sprintf(`
+		UPDATE users
+		SET %s
+		WHERE id = $%d
+		RETURNING `+privacyColumns,
+		strings.Join(sets, ", "), len(args),
+	)
+
+	var settings domain.PrivacySettings
+	if err := ur.db.GetContext(ctx, &settings, query, args...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, domain.ErrNotFound.WithMessage("User not found")
+		}
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// AreContacts reports whether otherID is in the contact list of userID.
+func (ur *UserRepo) AreContacts(ctx context.Context, userID, otherID int) (bool, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "AreContacts")
+	defer done()
+
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM contacts
+			WHERE user_id = $1 AND contact_id = $2
+		)
+	`
+
+	var contacts bool
+	err := ur.db.GetContext(ctx, &contacts, query,
+		userID,
+		otherID,
+	)
+	return contacts, err
+}
+
+// GetPresenceVisibility loads the presence privacy of users together with their relation to the viewer.
+// Unknown users are absent from the result.
+func (ur *UserRepo) GetPresenceVisibility(ctx context.Context, viewerID int, userIDs []int) ([]domain.PresenceVisibility, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "GetPresenceVisibility")
+	defer done()
+
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	query := `
+		SELECT
+			u.id AS user_id,
+			u.privacy_online_status AS online_privacy,
+			u.privacy_last_seen AS last_seen_privacy,
+			u.last_seen_at,
+			u.status_text,
+			u.status_emoji,
+			u.status_expires_at,
+			EXISTS (
+				SELECT 1 FROM contacts ct
+				WHERE ct.user_id = u.id AND ct.contact_id = $1
+			) AS is_contact,
+			EXISTS (
+				SELECT 1 FROM user_blocks ub
+				WHERE ub.blocker_id = u.id AND ub.blocked_id = $1
+			) AS blocked_viewer
+		FROM users u
+		WHERE u.id = ANY($2)
+	`
+
+	ids := make(pq.Int64Array, len(userIDs))
+	for i, userID := range userIDs {
+		ids[i] = int64(userID)
+	}
+
+	var result []domain.PresenceVisibility
+	err := ur.db.SelectContext(ctx, &result, query,
+		viewerID,
+		ids,
+	)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/ReilBleem13/MessangerV2/internal/service"
+	"github.com/redis/go-redis/v9"
+)
+
+type RateLimitRepo struct {
+	redis *redis.Client
+}
+
+func NewRateLimitRepo(redis *redis.Client) *RateLimitRepo {
+	return &RateLimitRepo{
+		redis: redis,
+	}
+}
+
+// Token bucket kept in a hash. Uses Redis time so every node refills buckets with the same clock.
+// Returns {allowed, retry after in ms}.
+var tokenBucketScript = redis.NewScript(`
+	local rate = tonumber(ARGV[1])
+	local burst = tonumber(ARGV[2])
+
+	local time = redis.call("TIME")
+	local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+	local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+	local tokens = tonumber(bucket[1]) or burst
+	local ts = tonumber(bucket[2]) or now
+
+	tokens = math.min(burst, tokens + (now - ts) * rate / 1000)
+
+	local allowed = 0
+	local retryAfter = 0
+	if tokens >= 1 then
+		tokens = tokens - 1
+		allowed = 1
+	else
+		retryAfter = math.ceil((1 - tokens) * 1000 / rate)
+	end
+
+	redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+	redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+
+	return {allowed, retryAfter}
+`)
+
+// Allow takes a token from the bucket under key and reports how long to wait if there was none.
+func (rl *RateLimitRepo) Allow(ctx context.Context, key string, limit service.RateLimit) (bool, time.Duration, error) {
+	res, err := tokenBucketScript.Run(ctx, rl.redis, []string{"ratelimit:" + key},
+		limit.Rate,
+		limit.Burst,
+	).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
+)
+
+func (ur *UserRepo) SetUserStatus(ctx context.Context, userID int, status *domain.UserStatus) error {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "SetUserStatus")
+	defer done()
+
+	query := `
+		UPDATE users
+		SET status_text = $1, status_emoji = $2, status_expires_at = $3
+		WHERE id = $4
+	`
+
+	res, err := ur.db.ExecContext(ctx, query, status.Text, status.Emoji, status.ExpiresAt, userID)
+	if err != nil {
+		return err
+	}
+	return expectUserUpdated(res)
+}
+
+func (ur *UserRepo) SetDNDSettings(ctx context.Context, userID int, dnd *domain.DNDSettings) error {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "SetDNDSettings")
+	defer done()
+
+	query := `
+		UPDATE users
+		SET dnd_until = $1, dnd_schedule_start = $2, dnd_schedule_end = $3, dnd_timezone = $4
+		WHERE id = $5
+	`
+
+	res, err := ur.db.ExecContext(ctx, query, dnd.Until, dnd.ScheduleStart, dnd.ScheduleEnd, dnd.Timezone, userID)
+	if err != nil {
+		return err
+	}
+	return expectUserUpdated(res)
+}
+
+// ClearExpiredStatuses resets statuses whose expiry has passed and returns the affected users.
+func (ur *UserRepo) ClearExpiredStatuses(ctx context.Context) ([]int, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "ClearExpiredStatuses")
+	defer done()
+
+	query := `
+		UPDATE users
+		SET status_text = '', status_emoji = '', status_expires_at = NULL
+		WHERE status_expires_at <= NOW()
+		RETURNING id
+	`
+
+	var userIDs []int
+	if err := ur.db.SelectContext(ctx, &userIDs, query); err != nil {
+		return nil, err
+	}
+	return userIDs, nil
+}
+
+func expectUserUpdated(res sql.Result) error {
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return domain.ErrNotFound.WithMessage("User not found")
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/ReilBleem13/MessangerV2/internal/service"
+	"github.com/redis/go-redis/v9"
+)
+
+func wsTicketKey(ticket string) string {
+	return "ws:ticket:" + ticket
+}
+
+func (cr *ConnectionRepo) SetWSTicket(ctx context.Context, ticket string, session *service.Session, ttl time.Duration) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+	return cr.redis.Set(ctx, wsTicketKey(ticket), data, ttl).Err()
+}
+
+// ConsumeWSTicket returns the session the ticket was issued for and deletes the ticket so it can't be replayed.
+func (cr *ConnectionRepo) ConsumeWSTicket(ctx context.Context, ticket string) (*service.Session, error) {
+	data, err := cr.redis.GetDel(ctx, wsTicketKey(ticket)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, domain.ErrInvalidToken
+		}
+		return nil, err
+	}
+
+	var session service.Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal session: %w", err)
+	}
+	return &session, nil
+}
+
+// GetSessionsRevokedAt returns when all sessions of the user were revoked, zero time if never.
+// session:revoked:{id} holds a unix timestamp and is written by the auth service on logout
+// or password change, tokens issued at or before it are no longer valid.
+func (cr *ConnectionRepo) GetSessionsRevokedAt(ctx context.Context, userID int) (time.Time, error) {
+	key := fmt.Sprintf("session:revoked:%d", userID)
+
+	revokedAt, err := cr.redis.Get(ctx, key).Int64()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return time.Unix(revokedAt, 0), nil
+}
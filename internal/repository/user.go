@@ -0,0 +1,218 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/ReilBleem13/MessangerV2/internal/service"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+type UserRepo struct {
+	db *sqlx.DB
+}
+
+func NewUserRepo(db *sqlx.DB) *UserRepo {
+	return &UserRepo{
+		db: db,
+	}
+}
+
+const userProfileColumns = `
+	id,
+	nickname,
+	email,
+	about,
+	experience,
+	github_url,
+	linkedin_url,
+	twitter_url,
+	telegram_url,
+	website_url,
+	discoverable,
+	last_seen_at,
+	privacy_last_seen,
+	privacy_online_status,
+	status_text,
+	status_emoji,
+	status_expires_at,
+	dnd_until,
+	dnd_schedule_start,
+	dnd_schedule_end,
+	dnd_timezone,
+	created_at,
+	updated_at
+`
+
+type userProfileRow struct {
+	domain.UserProfile
+	domain.UserStatus
+	domain.DNDSettings
+}
+
+func (row *userProfileRow) profile() *domain.UserProfile {
+	profile := row.UserProfile
+	profile.Status = &row.UserStatus
+	profile.DND = &row.DNDSettings
+	return &profile
+}
+
+func (ur *UserRepo) GetUserProfile(ctx context.Context, userID int) (*domain.UserProfile, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "GetUserProfile")
+	defer done()
+
+	query := `SELECT ` + userProfileColumns + ` FROM users WHERE id = $1`
+
+	var row userProfileRow
+	if err := ur.db.GetContext(ctx, &row, query, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, domain.ErrNotFound.WithMessage("User not found")
+		}
+		return nil, err
+	}
+	return row.profile(), nil
+}
+
+// UpdateUserProfile sets only the fields present in the dto, empty strings are stored as NULL.
+func (ur *UserRepo) UpdateUserProfile(ctx context.Context, userID int, in *service.UpdateProfileDTO) (*domain.UserProfile, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "UpdateUserProfile")
+	defer done()
+
+	var (
+		sets []string
+		args []any
+	)
+	set := func(column string, value any) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+	setText := func(column string, value *string) {
+		if value != nil {
+			set(column, sql.NullString{String: *value, Valid: *value != ""})
+		}
+	}
+
+	setText("about", in.About)
+	setText("experience", in.Experience)
+	setText("github_url", in.GithubURL)
+	setText("linkedin_url", in.LinkedinURL)
+	setText("twitter_url", in.TwitterURL)
+	setText("telegram_url", in.TelegramURL)
+	setText("website_url", in.WebsiteURL)
+	if in.Discoverable != nil {
+		set("discoverable", *in.Discoverable)
+	}
+	sets = append(sets, "updated_at = NOW()")
+
+	args = append(args, userID)
+	query := fmt.Sprintf(`
+		UPDATE users
+		SET %s
+		WHERE id = $%d
+		RETURNING `+userProfileColumns,
+		strings.Join(sets, ", "), len(args),
+	)
+
+	var row userProfileRow
+	if err := ur.db.GetContext(ctx, &row, query, args...); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, domain.ErrNotFound.WithMessage("User not found")
+		}
+		return nil, err
+	}
+	return row.profile(), nil
+}
+
+// SearchUsers matches nicknames by prefix and by trigram similarity, prefix matches first.
+// Users who are not discoverable or who blocked the caller are left out.
+func (ur *UserRepo) SearchUsers(ctx context.Context, in *service.SearchUsersDTO) ([]domain.UserSummary, *int, bool, error) {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "SearchUsers")
+	defer done()
+
+	query := `
+		SELECT
+			u.id,
+			u.nickname
+		FROM users u
+		WHERE u.id != $1
+			AND u.discoverable
+			AND (lower(u.nickname) LIKE $2 ESCAPE '\' OR lower(u.nickname) % $3)
+			AND NOT EXISTS (
+				SELECT 1 FROM user_blocks ub
+				WHERE ub.blocker_id = u.id AND ub.blocked_id = $1
+			)
+		ORDER BY
+			lower(u.nickname) LIKE $2 ESCAPE '\' DESC,
+			similarity(lower(u.nickname), $3) DESC,
+			u.id
+		LIMIT $4 OFFSET $5
+	`
+
+	q := strings.ToLower(in.Query)
+
+	offset := 0
+	if in.Cursor != nil {
+		offset = *in.Cursor
+	}
+
+	var users []domain.UserSummary
+	err := ur.db.SelectContext(ctx, &users, query,
+		in.UserID,
+		escapeLike(q)+"%",
+		q,
+		in.Limit+1,
+		offset,
+	)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, false, err
+	}
+
+	hasMore := len(users) > in.Limit
+	if hasMore {
+		users = users[:in.Limit]
+	}
+
+	var nextCursor *int
+	if hasMore {
+		next := offset + len(users)
+		nextCursor = &next
+	}
+	return users, nextCursor, hasMore, nil
+}
+
+// SetLastSeen stores last seen timestamps of many users in one statement, never moving them back in time.
+func (ur *UserRepo) SetLastSeen(ctx context.Context, lastSeen map[int]time.Time) error {
+	ctx, done := instrumentRepo(ctx, "UserRepo", "SetLastSeen")
+	defer done()
+
+	if len(lastSeen) == 0 {
+		return nil
+	}
+
+	ids := make(pq.Int64Array, 0, len(lastSeen))
+	timestamps := make(pq.StringArray, 0, len(lastSeen))
+	for userID, at := range lastSeen {
+		ids = append(ids, int64(userID))
+		timestamps = append(timestamps, at.UTC().Format(time.RFC3339Nano))
+	}
+
+	query := `
+		UPDATE users u
+		SET last_seen_at = v.last_seen_at
+		FROM unnest($1::INTEGER[], $2::TIMESTAMPTZ[]) AS v(id, last_seen_at)
+		WHERE u.id = v.id
+			AND (u.last_seen_at IS NULL OR u.last_seen_at < v.last_seen_at)
+	`
+
+	_, err := ur.db.ExecContext(ctx, query,
+		ids,
+		timestamps,
+	)
+	return err
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
+)
+
+func (h *Handler) handleGetContacts(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	contacts, err := h.userSrv.GetContacts(r.Context(), userID)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	if contacts == nil {
+		contacts = []domain.UserSummary{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(&ContactsResponse{
+		Contacts: contacts,
+	})
+}
+
+func (h *Handler) handleRemoveContact(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	contactIDStr := r.PathValue("user_id")
+	contactID, err := strconv.Atoi(contactIDStr)
+	if err != nil {
+		handleError(w, r, domain.ErrInvalidRequest)
+		return
+	}
+
+	if err := h.userSrv.RemoveContact(r.Context(), userID, contactID); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func (h *Handler) handleGetContactRequests(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	incoming, outgoing, err := h.userSrv.GetContactRequests(r.Context(), userID)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(&ContactRequestsResponse{
+		Incoming: incoming,
+		Outgoing: outgoing,
+	})
+}
+
+func (h *Handler) handleSendContactRequest(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	toIDStr := r.PathValue("user_id")
+	toID, err := strconv.Atoi(toIDStr)
+	if err != nil {
+		handleError(w, r, domain.ErrInvalidRequest)
+		return
+	}
+
+	request, accepted, err := h.userSrv.SendContactRequest(r.Context(), userID, toID)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	status := 201
+	if accepted {
+		status = 200
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&ContactRequestResponse{
+		Request:  request,
+		Accepted: accepted,
+	})
+}
+
+func (h *Handler) handleAcceptContactRequest(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	fromIDStr := r.PathValue("user_id")
+	fromID, err := strconv.Atoi(fromIDStr)
+	if err != nil {
+		handleError(w, r, domain.ErrInvalidRequest)
+		return
+	}
+
+	request, err := h.userSrv.AcceptContactRequest(r.Context(), userID, fromID)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(&ContactRequestResponse{
+		Request:  request,
+		Accepted: true,
+	})
+}
+
+func (h *Handler) handleDeclineContactRequest(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	fromIDStr := r.PathValue("user_id")
+	fromID, err := strconv.Atoi(fromIDStr)
+	if err != nil {
+		handleError(w, r, domain.ErrInvalidRequest)
+		return
+	}
+
+	if err := h.userSrv.DeclineContactRequest(r.Context(), userID, fromID); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func (h *Handler) handleCancelContactRequest(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	toIDStr := r.PathValue("user_id")
+	toID, err := strconv.Atoi(toIDStr)
+	if err != nil {
+		handleError(w, r, domain.ErrInvalidRequest)
+		return
+	}
+
+	if err := h.userSrv.CancelContactRequest(r.Context(), userID, toID); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -1,11 +1,21 @@
 package server
 
 import (
+	"time"
+
 	"github.com/ReilBleem13/MessangerV2/internal/domain"
 )
 
 type NewGroupJSON struct {
 	Name string `json:"name"`
+	// contacts to add right away
+	MemberIDs []int `json:"member_ids"`
+}
+
+// omitted fields are left unchanged, an empty description removes it
+type UpdateGroupJSON struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
 }
 
 type NewGroupMemberJSON struct {
@@ -25,13 +35,77 @@ type PaginateMessagesJSON struct {
 	Cursor *int `json:"cursor,omitempty"`
 }
 
+// omitted fields are left unchanged, "" clears the field
+type UpdateProfileJSON struct {
+	About       *string `json:"about"`
+	Experience  *string `json:"experience"`
+	GithubURL   *string `json:"github_url"`
+	LinkedinURL *string `json:"linkedin_url"`
+	TwitterURL  *string `json:"twitter_url"`
+	TelegramURL *string `json:"telegram_url"`
+	WebsiteURL  *string `json:"website_url"`
+	// false hides the user from search
+	Discoverable *bool `json:"discoverable"`
+}
+
+// omitted fields are left unchanged
+type UpdatePrivacyJSON struct {
+	OnlineStatus *domain.PrivacyLevel `json:"online_status"`
+	LastSeen     *domain.PrivacyLevel `json:"last_seen"`
+	GroupInvites *domain.PrivacyLevel `json:"group_invites"`
+	PrivateChats *domain.PrivacyLevel `json:"private_chats"`
+}
+
+type SetStatusJSON struct {
+	Text      string     `json:"text"`
+	Emoji     string     `json:"emoji"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// schedule times are "HH:MM" in timezone, e.g. "Europe/Berlin"
+type SetDNDJSON struct {
+	Until         *time.Time        `json:"until"`
+	ScheduleStart *domain.ClockTime `json:"schedule_start"`
+	ScheduleEnd   *domain.ClockTime `json:"schedule_end"`
+	Timezone      *string           `json:"timezone"`
+}
+
 // response
 type CreatedGroup struct {
 	GroupID int `json:"group_id"`
 }
 
+type WSTicket struct {
+	Ticket string `json:"ticket"`
+	// seconds
+	ExpiresIn int `json:"expires_in"`
+}
+
 type ChatMembers struct {
-	Members []*domain.ChatMember `json:"members"`
+	Members   []*domain.ChatMember `json:"members"`
+	NewCursor *int                 `json:"new_cursor,omitempty"`
+	HasMore   bool                 `json:"has_more"`
+}
+
+type SearchUsersResponse struct {
+	Users     []domain.UserSummary `json:"users"`
+	NewCursor *int                 `json:"new_cursor,omitempty"`
+	HasMore   bool                 `json:"has_more"`
+}
+
+type ContactsResponse struct {
+	Contacts []domain.UserSummary `json:"contacts"`
+}
+
+type ContactRequestsResponse struct {
+	Incoming []domain.ContactRequest `json:"incoming"`
+	Outgoing []domain.ContactRequest `json:"outgoing"`
+}
+
+type ContactRequestResponse struct {
+	Request *domain.ContactRequest `json:"request"`
+	// the user had already sent a request, so both are contacts now
+	Accepted bool `json:"accepted"`
 }
 
 type PaginateMessagesResponse struct {
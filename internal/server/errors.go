@@ -3,10 +3,10 @@ package server
 import (
 	"encoding/json"
 	"errors"
-	"log/slog"
 	"net/http"
 
 	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/ReilBleem13/MessangerV2/internal/logger"
 )
 
 type ErrorResponse struct {
@@ -31,7 +31,7 @@ func writeError(w http.ResponseWriter, err *domain.AppError) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func handleError(w http.ResponseWriter, err error) {
+func handleError(w http.ResponseWriter, r *http.Request, err error) {
 	var appErr *domain.AppError
 
 	if errors.As(err, &appErr) {
@@ -39,6 +39,6 @@ func handleError(w http.ResponseWriter, err error) {
 		return
 	}
 
-	slog.Error("Unhandled error", "error", err)
+	logger.FromContext(r.Context()).Error("Unhandled error", "error", err)
 	writeError(w, domain.ErrInternalServerError)
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/ReilBleem13/MessangerV2/internal/domain"
@@ -12,53 +13,111 @@ import (
 )
 
 type Handler struct {
-	msgSrv   service.MessageServiceIn
-	upgrader *websocket.Upgrader
+	msgSrv    service.MessageServiceIn
+	userSrv   service.UserServiceIn
+	ticketSrv service.TicketServiceIn
+	hub       *service.Hub
+	upgrader  *websocket.Upgrader
 }
 
-func NewHandler(msgSrv service.MessageServiceIn) *Handler {
+func NewHandler(msgSrv service.MessageServiceIn, userSrv service.UserServiceIn, ticketSrv service.TicketServiceIn,
+	hub *service.Hub, allowedOrigins []string) *Handler {
 	return &Handler{
-		msgSrv: msgSrv,
+		msgSrv:    msgSrv,
+		userSrv:   userSrv,
+		ticketSrv: ticketSrv,
+		hub:       hub,
 		upgrader: &websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferPool: &sync.Pool{},
+			Subprotocols:    []string{wsTokenProtocol},
+			CheckOrigin:     checkOrigin(allowedOrigins),
 		},
 	}
 }
 
+// checkOrigin allows handshakes without an Origin header (non browser clients) and from the listed origins.
+// Without a list it falls back to the upgrader default, which requires the origin to match the host.
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	origins := make(map[string]struct{}, len(allowed))
+	for _, origin := range allowed {
+		origins[strings.TrimSpace(origin)] = struct{}{}
+	}
+	_, allowAll := origins["*"]
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || allowAll {
+			return true
+		}
+		_, ok := origins[origin]
+		return ok
+	}
+}
+
+func (h *Handler) handleNewWSTicket(w http.ResponseWriter, r *http.Request) {
+	session, err := GetSessionFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	ticket, ttl, err := h.ticketSrv.IssueTicket(r.Context(), session)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(&WSTicket{
+		Ticket:    ticket,
+		ExpiresIn: int(ttl.Seconds()),
+	})
+}
+
 func (h *Handler) handleWS(w http.ResponseWriter, r *http.Request) {
-	userID, err := GetUserIDFromContext(r.Context())
+	if h.hub.Draining() {
+		handleError(w, r, domain.ErrServiceUnavailable)
+		return
+	}
+
+	session, err := GetSessionFromContext(r.Context())
 	if err != nil {
-		handleError(w, domain.ErrInternalServerError)
+		handleError(w, r, domain.ErrInternalServerError)
 		return
 	}
 
 	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		handleError(w, domain.ErrInternalServerError)
+		handleError(w, r, domain.ErrInternalServerError)
 		return
 	}
 
-	client := service.NewClient(userID, conn, service.GetHub())
+	client := service.NewClient(session, conn, h.hub)
 	h.msgSrv.HandleConn(r.Context(), client)
 }
 
 func (h *Handler) handleNewGroupChat(w http.ResponseWriter, r *http.Request) {
 	userID, err := GetUserIDFromContext(r.Context())
 	if err != nil {
-		handleError(w, domain.ErrInternalServerError)
+		handleError(w, r, domain.ErrInternalServerError)
 		return
 	}
 
 	var in NewGroupJSON
 	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
-		handleError(w, domain.ErrInvalidRequest)
+		handleError(w, r, domain.ErrInvalidRequest)
 		return
 	}
 
-	groupID, err := h.msgSrv.NewGroupChat(r.Context(), in.Name, userID)
+	groupID, err := h.msgSrv.NewGroupChat(r.Context(), in.Name, userID, in.MemberIDs)
 	if err != nil {
-		handleError(w, err)
+		handleError(w, r, err)
 		return
 	}
 
@@ -74,41 +133,125 @@ func (h *Handler) handleNewGroupChat(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) handleDeleteGroupChat(w http.ResponseWriter, r *http.Request) {
 	userID, err := GetUserIDFromContext(r.Context())
 	if err != nil {
-		handleError(w, domain.ErrInternalServerError)
+		handleError(w, r, domain.ErrInternalServerError)
 		return
 	}
 
 	chatIDStr := r.PathValue("chat_id")
 	chatID, err := strconv.Atoi(chatIDStr)
 	if err != nil {
-		handleError(w, domain.ErrInvalidRequest)
+		handleError(w, r, domain.ErrInvalidRequest)
 		return
 	}
 
 	if err := h.msgSrv.DeleteGroupChat(r.Context(), chatID, userID); err != nil {
-		handleError(w, err)
+		handleError(w, r, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+func (h *Handler) handleUpdateGroupChat(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	chatIDStr := r.PathValue("chat_id")
+	chatID, err := strconv.Atoi(chatIDStr)
+	if err != nil {
+		handleError(w, r, domain.ErrInvalidRequest)
+		return
+	}
+
+	var in UpdateGroupJSON
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		handleError(w, r, domain.ErrInvalidRequest)
+		return
+	}
+
+	chat, err := h.msgSrv.UpdateGroupChat(r.Context(), &service.UpdateGroupChatDTO{
+		ChatID:      chatID,
+		UserID:      userID,
+		Name:        in.Name,
+		Description: in.Description,
+	})
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	writeChat(w, chat)
+}
+
+// the request body is the image itself
+func (h *Handler) handleSetGroupAvatar(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
 		return
 	}
+
+	chatIDStr := r.PathValue("chat_id")
+	chatID, err := strconv.Atoi(chatIDStr)
+	if err != nil {
+		handleError(w, r, domain.ErrInvalidRequest)
+		return
+	}
+
+	chat, err := h.msgSrv.SetGroupAvatar(r.Context(), chatID, userID, r.Body)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	writeChat(w, chat)
+}
+
+func (h *Handler) handleRemoveGroupAvatar(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	chatIDStr := r.PathValue("chat_id")
+	chatID, err := strconv.Atoi(chatIDStr)
+	if err != nil {
+		handleError(w, r, domain.ErrInvalidRequest)
+		return
+	}
+
+	chat, err := h.msgSrv.RemoveGroupAvatar(r.Context(), chatID, userID)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	writeChat(w, chat)
+}
+
+func writeChat(w http.ResponseWriter, chat *domain.UserChat) {
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(chat)
 }
 
 func (h *Handler) handleNewGroupChatMember(w http.ResponseWriter, r *http.Request) {
 	userID, err := GetUserIDFromContext(r.Context())
 	if err != nil {
-		handleError(w, domain.ErrInternalServerError)
+		handleError(w, r, domain.ErrInternalServerError)
 		return
 	}
 
 	chatIDStr := r.PathValue("chat_id")
 	chatID, err := strconv.Atoi(chatIDStr)
 	if err != nil {
-		handleError(w, domain.ErrInvalidRequest)
+		handleError(w, r, domain.ErrInvalidRequest)
 		return
 	}
 
 	var in NewGroupMemberJSON
 	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
-		handleError(w, domain.ErrInvalidRequest)
+		handleError(w, r, domain.ErrInvalidRequest)
 		return
 	}
 
@@ -117,7 +260,7 @@ func (h *Handler) handleNewGroupChatMember(w http.ResponseWriter, r *http.Reques
 		SubjectID: userID,
 		ObjectID:  in.UserID,
 	}); err != nil {
-		handleError(w, err)
+		handleError(w, r, err)
 		return
 	}
 	w.WriteHeader(201)
@@ -126,27 +269,27 @@ func (h *Handler) handleNewGroupChatMember(w http.ResponseWriter, r *http.Reques
 func (h *Handler) handleDeleteGroupChatMember(w http.ResponseWriter, r *http.Request) {
 	userID, err := GetUserIDFromContext(r.Context())
 	if err != nil {
-		handleError(w, domain.ErrInternalServerError)
+		handleError(w, r, domain.ErrInternalServerError)
 		return
 	}
 
 	chatIDStr := r.PathValue("chat_id")
 	chatID, err := strconv.Atoi(chatIDStr)
 	if err != nil {
-		handleError(w, domain.ErrInvalidRequest)
+		handleError(w, r, domain.ErrInvalidRequest)
 		return
 	}
 
 	userIDToDeleteStr := r.PathValue("user_id")
 	userIDToDelete, err := strconv.Atoi(userIDToDeleteStr)
 	if err != nil {
-		handleError(w, domain.ErrInvalidRequest)
+		handleError(w, r, domain.ErrInvalidRequest)
 		return
 	}
 
 	var in DeleteGroupMemberJSON
 	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
-		handleError(w, domain.ErrInvalidRequest)
+		handleError(w, r, domain.ErrInvalidRequest)
 		return
 	}
 
@@ -156,7 +299,7 @@ func (h *Handler) handleDeleteGroupChatMember(w http.ResponseWriter, r *http.Req
 		ObjectID:  userIDToDelete,
 		Type:      &in.Type,
 	}); err != nil {
-		handleError(w, err)
+		handleError(w, r, err)
 		return
 	}
 	w.WriteHeader(200)
@@ -165,13 +308,13 @@ func (h *Handler) handleDeleteGroupChatMember(w http.ResponseWriter, r *http.Req
 func (h *Handler) handleGetUserChats(w http.ResponseWriter, r *http.Request) {
 	userID, err := GetUserIDFromContext(r.Context())
 	if err != nil {
-		handleError(w, domain.ErrInternalServerError)
+		handleError(w, r, domain.ErrInternalServerError)
 		return
 	}
 
 	groups, err := h.msgSrv.GetUserChats(r.Context(), userID)
 	if err != nil {
-		handleError(w, err)
+		handleError(w, r, err)
 		return
 	}
 
@@ -181,22 +324,64 @@ func (h *Handler) handleGetUserChats(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(groups)
 }
 
+// query params: cursor, limit, q (nickname prefix), role
 func (h *Handler) handleGetGroupChatMembers(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
 	chatIDStr := r.PathValue("chat_id")
 	chatID, err := strconv.Atoi(chatIDStr)
 	if err != nil {
-		handleError(w, domain.ErrInvalidRequest)
+		handleError(w, r, domain.ErrInvalidRequest)
 		return
 	}
 
-	members, err := h.msgSrv.GetAllGroupChatMembers(r.Context(), chatID)
+	in := &service.PaginateChatMembersDTO{
+		UserID: userID,
+		ChatID: chatID,
+	}
+
+	query := r.URL.Query()
+
+	if cursorStr := query.Get("cursor"); cursorStr != "" {
+		cursor, err := strconv.Atoi(cursorStr)
+		if err != nil {
+			handleError(w, r, domain.ErrInvalidRequest)
+			return
+		}
+		in.Cursor = &cursor
+	}
+
+	if limitStr := query.Get("limit"); limitStr != "" {
+		in.Limit, err = strconv.Atoi(limitStr)
+		if err != nil {
+			handleError(w, r, domain.ErrInvalidRequest)
+			return
+		}
+	}
+
+	if q := query.Get("q"); q != "" {
+		in.Query = &q
+	}
+
+	if roleStr := query.Get("role"); roleStr != "" {
+		role := domain.GroupMemberRole(roleStr)
+		in.Role = &role
+	}
+
+	members, newCursor, hasMore, err := h.msgSrv.PaginateGroupChatMembers(r.Context(), in)
 	if err != nil {
-		handleError(w, err)
+		handleError(w, r, err)
 		return
 	}
 
 	resp := &ChatMembers{
-		Members: members,
+		Members:   members,
+		NewCursor: newCursor,
+		HasMore:   hasMore,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -207,27 +392,27 @@ func (h *Handler) handleGetGroupChatMembers(w http.ResponseWriter, r *http.Reque
 func (h *Handler) handleUpdateGroupChatMemberRole(w http.ResponseWriter, r *http.Request) {
 	userID, err := GetUserIDFromContext(r.Context())
 	if err != nil {
-		handleError(w, domain.ErrInternalServerError)
+		handleError(w, r, domain.ErrInternalServerError)
 		return
 	}
 
 	chatIDStr := r.PathValue("chat_id")
 	chatID, err := strconv.Atoi(chatIDStr)
 	if err != nil {
-		handleError(w, domain.ErrInvalidRequest)
+		handleError(w, r, domain.ErrInvalidRequest)
 		return
 	}
 
 	userIDToUpdateStr := r.PathValue("user_id")
 	userIDToUpdate, err := strconv.Atoi(userIDToUpdateStr)
 	if err != nil {
-		handleError(w, domain.ErrInvalidRequest)
+		handleError(w, r, domain.ErrInvalidRequest)
 		return
 	}
 
 	var in UpdateGroupMemberRoleJSON
 	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
-		handleError(w, err)
+		handleError(w, r, err)
 		return
 	}
 
@@ -237,7 +422,7 @@ func (h *Handler) handleUpdateGroupChatMemberRole(w http.ResponseWriter, r *http
 		ObjectID:  userIDToUpdate,
 		ChatID:    chatID,
 	}); err != nil {
-		handleError(w, err)
+		handleError(w, r, err)
 		return
 	}
 	w.WriteHeader(200)
@@ -246,21 +431,21 @@ func (h *Handler) handleUpdateGroupChatMemberRole(w http.ResponseWriter, r *http
 func (h *Handler) handlePaginateMessages(w http.ResponseWriter, r *http.Request) {
 	userID, err := GetUserIDFromContext(r.Context())
 	if err != nil {
-		handleError(w, domain.ErrInternalServerError)
+		handleError(w, r, domain.ErrInternalServerError)
 		return
 	}
 
 	chatIDStr := r.PathValue("chat_id")
 	chatID, err := strconv.Atoi(chatIDStr)
 	if err != nil {
-		handleError(w, domain.ErrInvalidRequest)
+		handleError(w, r, domain.ErrInvalidRequest)
 		return
 	}
 
 	var in PaginateMessagesJSON
 	if r.Body != nil && r.ContentLength != 0 {
 		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
-			handleError(w, domain.ErrInvalidRequest)
+			handleError(w, r, domain.ErrInvalidRequest)
 			return
 		}
 	}
@@ -271,7 +456,7 @@ func (h *Handler) handlePaginateMessages(w http.ResponseWriter, r *http.Request)
 		Cursor: in.Cursor,
 	})
 	if err != nil {
-		handleError(w, err)
+		handleError(w, r, err)
 		return
 	}
 
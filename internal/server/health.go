@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ReilBleem13/MessangerV2/internal/repository/database"
+	"github.com/ReilBleem13/MessangerV2/internal/service"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+)
+
+const healthCheckTimeout = 2 * time.Second
+
+const (
+	statusOK   = "ok"
+	statusFail = "fail"
+)
+
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckStatus `json:"checks"`
+}
+
+type CheckStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type HealthChecker struct {
+	db    *sqlx.DB
+	cache *redis.Client
+	hub   *service.Hub
+}
+
+func NewHealthChecker(db *sqlx.DB, cache *redis.Client, hub *service.Hub) *HealthChecker {
+	return &HealthChecker{
+		db:    db,
+		cache: cache,
+		hub:   hub,
+	}
+}
+
+// liveness: the process is able to serve websocket traffic at all
+func (hc *HealthChecker) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, map[string]error{
+		"hub": hc.checkHub(),
+	})
+}
+
+// readiness: dependencies are reachable and the node is not draining
+func (hc *HealthChecker) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	checks := map[string]error{
+		"postgres":   hc.db.PingContext(ctx),
+		"redis":      hc.cache.Ping(ctx).Err(),
+		"migrations": database.CheckSchemaVersion(ctx, hc.db.DB),
+		"hub":        hc.checkHub(),
+	}
+
+	if hc.hub.Draining() {
+		checks["draining"] = errors.New("node is shutting down")
+	}
+	writeHealth(w, checks)
+}
+
+func (hc *HealthChecker) checkHub() error {
+	if !hc.hub.Running() {
+		return errors.New("hub is not running")
+	}
+	return nil
+}
+
+func writeHealth(w http.ResponseWriter, checks map[string]error) {
+	resp := HealthResponse{
+		Status: statusOK,
+		Checks: make(map[string]CheckStatus, len(checks)),
+	}
+
+	for name, err := range checks {
+		if err != nil {
+			resp.Status = statusFail
+			resp.Checks[name] = CheckStatus{Status: statusFail, Error: err.Error()}
+			continue
+		}
+		resp.Checks[name] = CheckStatus{Status: statusOK}
+	}
+
+	status := http.StatusOK
+	if resp.Status != statusOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
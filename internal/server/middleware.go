@@ -3,15 +3,57 @@ package server
 import (
 	"context"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
 
 	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/ReilBleem13/MessangerV2/internal/logger"
+	"github.com/ReilBleem13/MessangerV2/internal/metrics"
+	"github.com/ReilBleem13/MessangerV2/internal/service"
 	"github.com/ReilBleem13/MessangerV2/internal/utils"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 )
 
 type contextKey string
 
-const UserIDKey contextKey = "user_id"
+const (
+	UserIDKey  contextKey = "user_id"
+	SessionKey contextKey = "session"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+	// longer incoming ids are replaced, they end up in every log line
+	maxRequestIDLength = 64
+)
+
+// RequestLogMiddleware attaches a logger with request id, method, path and chat id to the request context.
+func RequestLogMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			requestID = uuid.NewString()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		args := []any{
+			"request_id", requestID,
+			"method", r.Method,
+			"path", r.URL.Path,
+		}
+		if chatID := r.PathValue("chat_id"); chatID != "" {
+			args = append(args, "chat_id", chatID)
+		}
+
+		ctx := logger.With(r.Context(), args...)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
 
 func AuthMiddleware(secret string) func(http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
@@ -24,22 +66,165 @@ func AuthMiddleware(secret string) func(http.Handler) http.Handler {
 
 			tokenString, err := utils.ExtractToken(authHeader)
 			if err != nil {
-				handleError(w, err)
+				handleError(w, r, err)
 				return
 			}
 
 			claims, err := utils.ValidateAccessToken(tokenString, secret)
 			if err != nil {
-				handleError(w, err)
+				handleError(w, r, err)
+				return
+			}
+
+			h.ServeHTTP(w, withSession(r, service.SessionFromClaims(claims)))
+		})
+	}
+}
+
+// Browsers can't set headers on the websocket handshake, so the token may come as
+// subprotocols "bearer, <token>". The server answers with "bearer" only.
+const wsTokenProtocol = "bearer"
+
+// WSAuthMiddleware authenticates the websocket handshake with a single use ticket from
+// POST /ws/ticket in the ticket query parameter, an access token in Sec-WebSocket-Protocol
+// or the Authorization header, in that order.
+func WSAuthMiddleware(secret string, tickets service.TicketServiceIn) func(http.Handler) http.Handler {
+	authMiddleware := AuthMiddleware(secret)
+
+	return func(h http.Handler) http.Handler {
+		headerAuth := authMiddleware(h)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+				session, err := tickets.RedeemTicket(r.Context(), ticket)
+				if err != nil {
+					handleError(w, r, err)
+					return
+				}
+				h.ServeHTTP(w, withSession(r, session))
+				return
+			}
+
+			if protocols := websocket.Subprotocols(r); len(protocols) == 2 && protocols[0] == wsTokenProtocol {
+				claims, err := utils.ValidateAccessToken(protocols[1], secret)
+				if err != nil {
+					handleError(w, r, err)
+					return
+				}
+				h.ServeHTTP(w, withSession(r, service.SessionFromClaims(claims)))
+				return
+			}
+
+			headerAuth.ServeHTTP(w, r)
+		})
+	}
+}
+
+func withSession(r *http.Request, session *service.Session) *http.Request {
+	ctx := context.WithValue(r.Context(), UserIDKey, session.UserID)
+	ctx = context.WithValue(ctx, SessionKey, session)
+	ctx = logger.With(ctx, "user_id", session.UserID)
+	return r.WithContext(ctx)
+}
+
+// IPRateLimitMiddleware limits requests per client ip. X-Forwarded-For is only used when the peer
+// is one of trustedProxies, see clientIP.
+func IPRateLimitMiddleware(limiter service.RateLimitRepoIn, limit service.RateLimit, trustedProxies []netip.Prefix) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r, trustedProxies)
+
+			if !allowRequest(w, r, limiter, "http_ip", ip, limit) {
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientIP is the peer address unless the peer is a trusted proxy. Then X-Forwarded-For is walked
+// from the right and the first address that is not a trusted proxy is the client, anything left of it
+// could have been sent by the client itself.
+func clientIP(r *http.Request, trustedProxies []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !isTrustedProxy(peer, trustedProxies) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			// a garbled hop can't be trusted, neither can anything before it
+			break
+		}
+		peer = addr
+		if !isTrustedProxy(addr, trustedProxies) {
+			break
+		}
+	}
+	return peer.Unmap().String()
+}
+
+func isTrustedProxy(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// UserRateLimitMiddleware limits requests per authenticated user, it must run after AuthMiddleware.
+func UserRateLimitMiddleware(limiter service.RateLimitRepoIn, limit service.RateLimit) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, err := GetUserIDFromContext(r.Context())
+			if err != nil {
+				handleError(w, r, err)
 				return
 			}
 
-			ctx := context.WithValue(r.Context(), UserIDKey, claims.UserID)
-			h.ServeHTTP(w, r.WithContext(ctx))
+			if !allowRequest(w, r, limiter, "http_user", strconv.Itoa(userID), limit) {
+				return
+			}
+			h.ServeHTTP(w, r)
 		})
 	}
 }
 
+// allowRequest writes 429 with Retry-After when the bucket is empty. Requests pass if Redis is unavailable.
+func allowRequest(w http.ResponseWriter, r *http.Request, limiter service.RateLimitRepoIn,
+	scope, key string, limit service.RateLimit) bool {
+	allowed, retryAfter, err := limiter.Allow(r.Context(), scope+":"+key, limit)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("Failed to check rate limit", "scope", scope, "error", err)
+		return true
+	}
+	if allowed {
+		return true
+	}
+
+	metrics.RateLimited.WithLabelValues(scope).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeError(w, domain.ErrTooManyRequests)
+	return false
+}
+
+func GetSessionFromContext(ctx context.Context) (*service.Session, error) {
+	session, ok := ctx.Value(SessionKey).(*service.Session)
+	if !ok {
+		return nil, fmt.Errorf("session not found in context")
+	}
+	return session, nil
+}
+
 func GetUserIDFromContext(ctx context.Context) (int, error) {
 	userID, ok := ctx.Value(UserIDKey).(int)
 	if !ok {
@@ -1,78 +1,180 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/ReilBleem13/MessangerV2/internal/config"
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
 	"github.com/ReilBleem13/MessangerV2/internal/repository"
 	"github.com/ReilBleem13/MessangerV2/internal/repository/cache"
 	"github.com/ReilBleem13/MessangerV2/internal/repository/database"
 	"github.com/ReilBleem13/MessangerV2/internal/service"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
-type Option func(*Server)
-
-func WithMigrateDown(m func() error) Option {
-	return func(s *Server) {
-		s.migrateDown = m
-	}
-}
-
 type Server struct {
-	ctx         context.Context
-	router      *http.ServeMux
-	cfg         *config.Config
-	migrateDown func() error
+	ctx    context.Context
+	router *http.ServeMux
+	cfg    *config.Config
+
+	hub *service.Hub
+	// applied to every route registered with handle
+	apiMiddleware func(http.Handler) http.Handler
+	// cancels background workers: hub subscription and offline scanner
+	stopWorkers context.CancelFunc
+	workers     sync.WaitGroup
 }
 
-func NewServer(ctx context.Context, cfg *config.Config, opts ...Option) *Server {
+func NewServer(ctx context.Context, cfg *config.Config) *Server {
 	s := &Server{
 		ctx:    ctx,
 		router: http.NewServeMux(),
 		cfg:    cfg,
 	}
 
-	for _, opt := range opts {
-		opt(s)
-	}
-
 	msgRepository := repository.NewMessageRepo(database.Client(), cache.Client())
 	connRepository := repository.NewConnectionRepo(cache.Client())
+	rateLimitRepository := repository.NewRateLimitRepo(cache.Client())
+	userRepository := repository.NewUserRepo(database.Client())
+	fileStore := repository.NewFileStore(database.Client(), uploadsPrefix)
 
-	heartbeatService := service.NewHeartbeatService(ctx, connRepository, msgRepository)
-	msgService := service.NewMessageService(heartbeatService, msgRepository, connRepository)
+	nodeID := cfg.App.NodeID
+	if nodeID == "" {
+		nodeID = uuid.NewString()
+	}
 
-	h := NewHandler(msgService)
-	s.setupRoutes(h)
+	s.hub = service.NewHub(nodeID, connRepository,
+		service.WithSendQueue(cfg.WebSocket.SendQueueSize, service.QueuePolicy(cfg.WebSocket.SendQueuePolicy)),
+	)
+
+	heartbeatService := service.NewHeartbeatService(connRepository, msgRepository, userRepository, s.hub)
+	rl := cfg.RateLimit
+	msgService := service.NewMessageService(heartbeatService, msgRepository, connRepository, userRepository, s.hub,
+		service.WithFrameRateLimits(rateLimitRepository, map[domain.EventType]service.RateLimit{
+			domain.SendMesageType:          {Rate: rl.SendRate, Burst: rl.SendBurst},
+			domain.MessageReadType:         {Rate: rl.ReadRate, Burst: rl.ReadBurst},
+			domain.MessageDeliveredType:    {Rate: rl.DeliveredRate, Burst: rl.DeliveredBurst},
+			domain.PresenceSubscribeType:   {Rate: rl.PresenceRate, Burst: rl.PresenceBurst},
+			domain.PresenceUnsubscribeType: {Rate: rl.PresenceRate, Burst: rl.PresenceBurst},
+			domain.ReauthType:              {Rate: rl.ReauthRate, Burst: rl.ReauthBurst},
+		}),
+		service.WithSessionAuth(cfg.JWT.Secret, connRepository, cfg.JWT.ExpiryWarning),
+		service.WithAvatarStore(fileStore, cfg.Uploads.MaxAvatarSize),
+	)
+
+	workersCtx, stopWorkers := context.WithCancel(ctx)
+	s.stopWorkers = stopWorkers
+	s.workers.Go(func() { s.hub.Run(workersCtx) })
+	s.workers.Go(func() { heartbeatService.Run(workersCtx) })
+
+	ticketService := service.NewTicketService(connRepository, cfg.WebSocket.TicketTTL)
+
+	userService := service.NewUserService(userRepository, msgRepository, heartbeatService, s.hub)
+
+	h := NewHandler(msgService, userService, ticketService, s.hub, cfg.WebSocket.AllowedOrigins)
+	hc := NewHealthChecker(database.Client(), cache.Client(), s.hub)
+	s.setupRoutes(h, hc, rateLimitRepository, fileStore)
 
 	return s
 }
 
-func (s *Server) setupRoutes(h *Handler) {
+func (s *Server) setupRoutes(h *Handler, hc *HealthChecker, limiter service.RateLimitRepoIn, files *repository.FileStore) {
 	authMiddleware := AuthMiddleware(s.cfg.JWT.Secret)
-
-	s.router.Handle("/ws", authMiddleware(http.HandlerFunc(h.handleWS)))
-	s.router.Handle("POST /chats", authMiddleware(http.HandlerFunc(h.handleNewGroupChat)))
-	s.router.Handle("DELETE /chats/{chat_id}", authMiddleware(http.HandlerFunc(h.handleDeleteGroupChat)))
-	s.router.Handle("POST /chats/{chat_id}/members", authMiddleware(http.HandlerFunc(h.handleNewGroupChatMember)))
-	s.router.Handle("DELETE /chats/{chat_id}/members/{user_id}", authMiddleware(http.HandlerFunc(h.handleDeleteGroupChatMember)))
-	s.router.Handle("PATCH /chats/{chat_id}/members/{user_id}", authMiddleware(http.HandlerFunc(h.handleUpdateGroupChatMemberRole)))
-	s.router.Handle("GET /chats/{chat_id}/members", authMiddleware(http.HandlerFunc(h.handleGetGroupChatMembers)))
-
-	s.router.Handle("GET /users/chats", authMiddleware(http.HandlerFunc(h.handleGetUserChats)))
-	s.router.Handle("GET /users/chat/{chat_id}", authMiddleware(http.HandlerFunc(h.handlePaginateMessages)))
+	trustedProxies, err := s.cfg.App.TrustedProxyPrefixes()
+	if err != nil {
+		log.Fatalf("failed to parse trusted proxies: %v", err)
+	}
+	ipLimit := IPRateLimitMiddleware(limiter, service.RateLimit{
+		Rate:  s.cfg.RateLimit.HTTPIPRate,
+		Burst: s.cfg.RateLimit.HTTPIPBurst,
+	}, trustedProxies)
+	userLimit := UserRateLimitMiddleware(limiter, service.RateLimit{
+		Rate:  s.cfg.RateLimit.HTTPUserRate,
+		Burst: s.cfg.RateLimit.HTTPUserBurst,
+	})
+	s.apiMiddleware = ipLimit
+
+	s.router.Handle("/ws", RequestLogMiddleware(ipLimit(WSAuthMiddleware(s.cfg.JWT.Secret, h.ticketSrv)(http.HandlerFunc(h.handleWS)))))
+	s.handle("POST /ws/ticket", authMiddleware(userLimit(http.HandlerFunc(h.handleNewWSTicket))))
+	s.handle("POST /chats", authMiddleware(userLimit(http.HandlerFunc(h.handleNewGroupChat))))
+	s.handle("DELETE /chats/{chat_id}", authMiddleware(userLimit(http.HandlerFunc(h.handleDeleteGroupChat))))
+	s.handle("PATCH /chats/{chat_id}", authMiddleware(userLimit(http.HandlerFunc(h.handleUpdateGroupChat))))
+	s.handle("PUT /chats/{chat_id}/avatar", authMiddleware(userLimit(http.HandlerFunc(h.handleSetGroupAvatar))))
+	s.handle("DELETE /chats/{chat_id}/avatar", authMiddleware(userLimit(http.HandlerFunc(h.handleRemoveGroupAvatar))))
+	s.handle("POST /chats/{chat_id}/members", authMiddleware(userLimit(http.HandlerFunc(h.handleNewGroupChatMember))))
+	s.handle("DELETE /chats/{chat_id}/members/{user_id}", authMiddleware(userLimit(http.HandlerFunc(h.handleDeleteGroupChatMember))))
+	s.handle("PATCH /chats/{chat_id}/members/{user_id}", authMiddleware(userLimit(http.HandlerFunc(h.handleUpdateGroupChatMemberRole))))
+	s.handle("GET /chats/{chat_id}/members", authMiddleware(http.HandlerFunc(h.handleGetGroupChatMembers)))
+
+	s.handle("GET /users/chats", authMiddleware(http.HandlerFunc(h.handleGetUserChats)))
+	s.handle("GET /users/chat/{chat_id}", authMiddleware(http.HandlerFunc(h.handlePaginateMessages)))
+	s.handle("GET /users/me", authMiddleware(http.HandlerFunc(h.handleGetMe)))
+	s.handle("PATCH /users/me", authMiddleware(userLimit(http.HandlerFunc(h.handleUpdateMe))))
+	s.handle("GET /users/me/privacy", authMiddleware(http.HandlerFunc(h.handleGetPrivacy)))
+	s.handle("PATCH /users/me/privacy", authMiddleware(userLimit(http.HandlerFunc(h.handleUpdatePrivacy))))
+	s.handle("PUT /users/me/status", authMiddleware(userLimit(http.HandlerFunc(h.handleSetStatus))))
+	s.handle("DELETE /users/me/status", authMiddleware(userLimit(http.HandlerFunc(h.handleClearStatus))))
+	s.handle("PUT /users/me/dnd", authMiddleware(userLimit(http.HandlerFunc(h.handleSetDND))))
+	s.handle("DELETE /users/me/dnd", authMiddleware(userLimit(http.HandlerFunc(h.handleClearDND))))
+	s.handle("GET /users/me/contacts", authMiddleware(http.HandlerFunc(h.handleGetContacts)))
+	s.handle("DELETE /users/me/contacts/{user_id}", authMiddleware(userLimit(http.HandlerFunc(h.handleRemoveContact))))
+	s.handle("GET /users/me/contact-requests", authMiddleware(http.HandlerFunc(h.handleGetContactRequests)))
+	s.handle("POST /users/me/contact-requests/{user_id}", authMiddleware(userLimit(http.HandlerFunc(h.handleSendContactRequest))))
+	s.handle("DELETE /users/me/contact-requests/{user_id}", authMiddleware(userLimit(http.HandlerFunc(h.handleCancelContactRequest))))
+	s.handle("POST /users/me/contact-requests/{user_id}/accept", authMiddleware(userLimit(http.HandlerFunc(h.handleAcceptContactRequest))))
+	s.handle("POST /users/me/contact-requests/{user_id}/decline", authMiddleware(userLimit(http.HandlerFunc(h.handleDeclineContactRequest))))
+	s.handle("POST /users/me/blocks/{user_id}", authMiddleware(userLimit(http.HandlerFunc(h.handleBlockUser))))
+	s.handle("DELETE /users/me/blocks/{user_id}", authMiddleware(userLimit(http.HandlerFunc(h.handleUnblockUser))))
+	s.handle("GET /users/search", authMiddleware(http.HandlerFunc(h.handleSearchUsers)))
+	s.handle("GET /users/{id}", authMiddleware(http.HandlerFunc(h.handleGetUser)))
+
+	s.router.HandleFunc("GET /healthz", hc.handleHealthz)
+	s.router.HandleFunc("GET /readyz", hc.handleReadyz)
+	s.router.Handle("GET /metrics", promhttp.Handler())
+
+	s.router.Handle("GET "+uploadsPrefix+"{name}", uploadsHandler(files))
 
 	fileServer := http.FileServer(http.Dir("./web"))
 	s.router.Handle("/", http.StripPrefix("/", fileServer))
 }
 
+const uploadsPrefix = "/uploads/"
+
+// how long Run still waits for connections after draining timed out
+const connWaitTimeout = 5 * time.Second
+
+// uploadsHandler serves uploaded files from the shared store, the content type follows the extension.
+func uploadsHandler(files *repository.FileStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upload, err := files.Get(r.Context(), r.PathValue("name"))
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		http.ServeContent(w, r, upload.Name, upload.CreatedAt, bytes.NewReader(upload.Data))
+	})
+}
+
+// handle registers an API route with a request scoped logger, the per ip rate limit
+// and a span per request named after the route pattern.
+func (s *Server) handle(pattern string, handler http.Handler) {
+	s.router.Handle(pattern, otelhttp.NewHandler(RequestLogMiddleware(s.apiMiddleware(handler)), pattern))
+}
+
 func (s *Server) Run(addr string) error {
 	server := &http.Server{
 		Addr:    addr,
@@ -90,17 +192,48 @@ func (s *Server) Run(addr string) error {
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 
 	<-quit
+	slog.Info("Shutting down")
 
 	ctx, shutdown := context.WithTimeout(s.ctx, 10*time.Second)
 	defer shutdown()
 
-	if s.migrateDown != nil {
-		if err := s.migrateDown(); err != nil {
-			slog.Warn("Failed to migrate down", "error", err)
-		}
-		slog.Info("Migrations down")
+	// readiness fails and upgrades are rejected from here on, the listener stays open
+	// so the load balancer can still observe /readyz while sessions drain
+	drained := true
+	if err := s.hub.Drain(ctx); err != nil {
+		slog.Warn("Failed to drain websocket sessions", "error", err)
+
+		// connection handlers still use redis and postgres, give them a last chance to finish
+		waitCtx, cancel := context.WithTimeout(context.WithoutCancel(s.ctx), connWaitTimeout)
+		drained = s.hub.Wait(waitCtx) == nil
+		cancel()
+	}
+	if drained {
+		slog.Info("Websocket sessions drained")
+	}
+
+	// hijacked websocket connections are not affected by Shutdown
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Failed to shutdown http server", "error", err)
+	}
+
+	s.stopWorkers()
+	s.workers.Wait()
+
+	if !drained {
+		// the process exits anyway, closing the clients under live handlers only makes them fail
+		slog.Warn("Websocket sessions are still open, leaving redis and database clients open")
+		slog.Info("Server exited")
+		return nil
+	}
+
+	if err := cache.Client().Close(); err != nil {
+		slog.Warn("Failed to close redis client", "error", err)
+	}
+	if err := database.Client().Close(); err != nil {
+		slog.Warn("Failed to close database client", "error", err)
 	}
 
 	slog.Info("Server exited")
-	return server.Shutdown(ctx)
+	return nil
 }
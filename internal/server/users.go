@@ -0,0 +1,306 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/ReilBleem13/MessangerV2/internal/service"
+)
+
+func (h *Handler) handleGetUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	targetIDStr := r.PathValue("id")
+	targetID, err := strconv.Atoi(targetIDStr)
+	if err != nil {
+		handleError(w, r, domain.ErrInvalidRequest)
+		return
+	}
+
+	h.writeProfile(w, r, userID, targetID)
+}
+
+func (h *Handler) handleGetMe(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	h.writeProfile(w, r, userID, userID)
+}
+
+func (h *Handler) writeProfile(w http.ResponseWriter, r *http.Request, viewerID, userID int) {
+	profile, err := h.userSrv.GetProfile(r.Context(), viewerID, userID)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(profile)
+}
+
+func (h *Handler) handleUpdateMe(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	var in UpdateProfileJSON
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		handleError(w, r, domain.ErrInvalidRequest)
+		return
+	}
+
+	profile, err := h.userSrv.UpdateProfile(r.Context(), userID, &service.UpdateProfileDTO{
+		About:       in.About,
+		Experience:  in.Experience,
+		GithubURL:   in.GithubURL,
+		LinkedinURL: in.LinkedinURL,
+		TwitterURL:  in.TwitterURL,
+		TelegramURL: in.TelegramURL,
+		WebsiteURL:  in.WebsiteURL,
+
+		Discoverable: in.Discoverable,
+	})
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(profile)
+}
+
+// query params: q, cursor, limit
+func (h *Handler) handleSearchUsers(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+
+	in := &service.SearchUsersDTO{
+		UserID: userID,
+		Query:  query.Get("q"),
+	}
+
+	if cursorStr := query.Get("cursor"); cursorStr != "" {
+		cursor, err := strconv.Atoi(cursorStr)
+		if err != nil {
+			handleError(w, r, domain.ErrInvalidRequest)
+			return
+		}
+		in.Cursor = &cursor
+	}
+
+	if limitStr := query.Get("limit"); limitStr != "" {
+		in.Limit, err = strconv.Atoi(limitStr)
+		if err != nil {
+			handleError(w, r, domain.ErrInvalidRequest)
+			return
+		}
+	}
+
+	users, newCursor, hasMore, err := h.userSrv.SearchUsers(r.Context(), in)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	resp := &SearchUsersResponse{
+		Users:     users,
+		NewCursor: newCursor,
+		HasMore:   hasMore,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *Handler) handleBlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	blockedIDStr := r.PathValue("user_id")
+	blockedID, err := strconv.Atoi(blockedIDStr)
+	if err != nil {
+		handleError(w, r, domain.ErrInvalidRequest)
+		return
+	}
+
+	if err := h.userSrv.BlockUser(r.Context(), userID, blockedID); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func (h *Handler) handleUnblockUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	blockedIDStr := r.PathValue("user_id")
+	blockedID, err := strconv.Atoi(blockedIDStr)
+	if err != nil {
+		handleError(w, r, domain.ErrInvalidRequest)
+		return
+	}
+
+	if err := h.userSrv.UnblockUser(r.Context(), userID, blockedID); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func (h *Handler) handleGetPrivacy(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	settings, err := h.userSrv.GetPrivacySettings(r.Context(), userID)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(settings)
+}
+
+func (h *Handler) handleUpdatePrivacy(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	var in UpdatePrivacyJSON
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		handleError(w, r, domain.ErrInvalidRequest)
+		return
+	}
+
+	settings, err := h.userSrv.UpdatePrivacySettings(r.Context(), userID, &service.UpdatePrivacyDTO{
+		OnlineStatus: in.OnlineStatus,
+		LastSeen:     in.LastSeen,
+		GroupInvites: in.GroupInvites,
+		PrivateChats: in.PrivateChats,
+	})
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(settings)
+}
+
+func (h *Handler) handleSetStatus(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	var in SetStatusJSON
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		handleError(w, r, domain.ErrInvalidRequest)
+		return
+	}
+
+	h.writeStatus(w, r, userID, &domain.UserStatus{
+		Text:      in.Text,
+		Emoji:     in.Emoji,
+		ExpiresAt: in.ExpiresAt,
+	})
+}
+
+func (h *Handler) handleClearStatus(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	h.writeStatus(w, r, userID, &domain.UserStatus{})
+}
+
+func (h *Handler) writeStatus(w http.ResponseWriter, r *http.Request, userID int, in *domain.UserStatus) {
+	status, err := h.userSrv.SetStatus(r.Context(), userID, in)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(status)
+}
+
+func (h *Handler) handleSetDND(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	var in SetDNDJSON
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		handleError(w, r, domain.ErrInvalidRequest)
+		return
+	}
+
+	h.writeDND(w, r, userID, &domain.DNDSettings{
+		Until:         in.Until,
+		ScheduleStart: in.ScheduleStart,
+		ScheduleEnd:   in.ScheduleEnd,
+		Timezone:      in.Timezone,
+	})
+}
+
+func (h *Handler) handleClearDND(w http.ResponseWriter, r *http.Request) {
+	userID, err := GetUserIDFromContext(r.Context())
+	if err != nil {
+		handleError(w, r, domain.ErrInternalServerError)
+		return
+	}
+
+	h.writeDND(w, r, userID, &domain.DNDSettings{})
+}
+
+func (h *Handler) writeDND(w http.ResponseWriter, r *http.Request, userID int, in *domain.DNDSettings) {
+	dnd, err := h.userSrv.SetDND(r.Context(), userID, in)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(dnd)
+}
@@ -0,0 +1,175 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/ReilBleem13/MessangerV2/internal/logger"
+)
+
+const (
+	// chats.name is VARCHAR(100), chats.description VARCHAR(500)
+	maxGroupNameLength        = 100
+	maxGroupDescriptionLength = 500
+)
+
+// avatar content types, as sniffed from the upload, and the extension they are stored with
+var avatarExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// normalizeGroupName trims name and checks it fits, the same rules apply on create and rename.
+func normalizeGroupName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxGroupNameLength {
+		return "", domain.ErrInvalidRequest.WithMessage("Group name must be 1 to 100 characters")
+	}
+	return name, nil
+}
+
+func (ms *MessageService) UpdateGroupChat(ctx context.Context, in *UpdateGroupChatDTO) (*domain.UserChat, error) {
+	if in.Name != nil {
+		name, err := normalizeGroupName(*in.Name)
+		if err != nil {
+			return nil, err
+		}
+		in.Name = &name
+	}
+	if in.Description != nil {
+		description := strings.TrimSpace(*in.Description)
+		if utf8.RuneCountInString(description) > maxGroupDescriptionLength {
+			return nil, domain.ErrInvalidRequest.WithMessage("Group description is too long")
+		}
+		in.Description = &description
+	}
+	// only set from an upload
+	in.AvatarURL = nil
+
+	if err := ms.requireGroupAdmin(ctx, in.UserID, in.ChatID); err != nil {
+		return nil, err
+	}
+	return ms.applyGroupChatUpdate(ctx, in)
+}
+
+// SetGroupAvatar stores the uploaded image and makes it the avatar of the group.
+func (ms *MessageService) SetGroupAvatar(ctx context.Context, chatID, userID int, image io.Reader) (*domain.UserChat, error) {
+	if ms.avatarStore == nil {
+		return nil, domain.ErrInternalServerError.WithMessage("Avatar uploads are disabled")
+	}
+
+	if err := ms.requireGroupAdmin(ctx, userID, chatID); err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(image, ms.maxAvatarSize+1))
+	if err != nil {
+		return nil, domain.ErrInvalidRequest.WithMessage("Failed to read avatar")
+	}
+	if int64(len(data)) > ms.maxAvatarSize {
+		return nil, domain.ErrInvalidRequest.WithMessage("Avatar is too large")
+	}
+
+	ext, ok := avatarExtensions[http.DetectContentType(data)]
+	if !ok {
+		return nil, domain.ErrInvalidRequest.WithMessage("Avatar must be a png, jpeg, gif or webp image")
+	}
+
+	url, err := ms.avatarStore.Save(ctx, data, ext)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to save avatar", "error", err)
+		return nil, err
+	}
+
+	chat, err := ms.applyGroupChatUpdate(ctx, &UpdateGroupChatDTO{
+		ChatID:    chatID,
+		UserID:    userID,
+		AvatarURL: &url,
+	})
+	if err != nil {
+		ms.deleteAvatar(ctx, url)
+		return nil, err
+	}
+	return chat, nil
+}
+
+func (ms *MessageService) RemoveGroupAvatar(ctx context.Context, chatID, userID int) (*domain.UserChat, error) {
+	if err := ms.requireGroupAdmin(ctx, userID, chatID); err != nil {
+		return nil, err
+	}
+
+	noAvatar := ""
+	return ms.applyGroupChatUpdate(ctx, &UpdateGroupChatDTO{
+		ChatID:    chatID,
+		UserID:    userID,
+		AvatarURL: &noAvatar,
+	})
+}
+
+func (ms *MessageService) requireGroupAdmin(ctx context.Context, userID, chatID int) error {
+	role, err := ms.msgRepo.GetGroupChatMemberRole(ctx, userID, chatID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get user role in group chat", "error", err)
+		return err
+	}
+
+	if role != domain.AdminRole {
+		logger.FromContext(ctx).Warn("Not admin trying to update group chat", "subject", userID, "chat_id", chatID)
+		return domain.ErrForbidden.WithMessage("Only admins can change the group")
+	}
+	return nil
+}
+
+// applyGroupChatUpdate saves the changes and sends chat_updated with the resulting system messages to the members.
+func (ms *MessageService) applyGroupChatUpdate(ctx context.Context, in *UpdateGroupChatDTO) (*domain.UserChat, error) {
+	updated, err := ms.msgRepo.UpdateGroupChat(ctx, in)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to update group chat", "error", err)
+		return nil, err
+	}
+
+	if updated.OldAvatarURL != nil {
+		ms.deleteAvatar(ctx, *updated.OldAvatarURL)
+	}
+	if len(updated.Messages) == 0 {
+		return updated.Chat, nil
+	}
+
+	chatUpdatedEventByte, err := json.Marshal(&ChatUpdatedEvent{
+		Chat:        updated.Chat,
+		UpdatedByID: in.UserID,
+		Messages:    updated.Messages,
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to marshal data", "error", err)
+		return updated.Chat, nil
+	}
+
+	memberIDs, err := ms.msgRepo.GetChatMemberIDs(ctx, in.ChatID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get all group chat members", "error", err)
+		return updated.Chat, nil
+	}
+
+	ms.hub.broadcast(ctx, memberIDs, &ProduceMessage{
+		Type: domain.ChatUpdatedType,
+		Data: chatUpdatedEventByte,
+	})
+	return updated.Chat, nil
+}
+
+func (ms *MessageService) deleteAvatar(ctx context.Context, url string) {
+	if ms.avatarStore == nil {
+		return
+	}
+	if err := ms.avatarStore.Delete(ctx, url); err != nil {
+		logger.FromContext(ctx).Warn("Failed to delete avatar", "url", url, "error", err)
+	}
+}
@@ -1,24 +1,166 @@
 package service
 
 import (
+	"errors"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ReilBleem13/MessangerV2/internal/metrics"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	"github.com/redis/go-redis/v9"
+)
+
+// Sent when the outbound queue overflowed and events were lost,
+// the client has to refetch its state after reconnecting.
+const CloseResyncRequired = 4000
+
+const goingAwayText = "server going away, reconnect elsewhere"
+
+var (
+	errResyncRequired = errors.New("outbound queue overflow, resync required")
+	errGoingAway      = errors.New("server is shutting down")
 )
 
 type Client struct {
-	id       int
-	conn     *websocket.Conn
-	outboard <-chan *redis.Message
-	hub      *Hub
+	id     int
+	connID string
+	conn   *websocket.Conn
+	queue  *sendQueue
+	hub    *Hub
+	log    *slog.Logger
+
+	resync     chan struct{}
+	resyncOnce sync.Once
+
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+
+	sessionMu sync.Mutex
+	session   Session
+	// wakes the session watcher after a reauth
+	reauthed chan struct{}
+	// closed with sessionErr set when the token expired or was revoked
+	sessionEnd     chan struct{}
+	sessionEndOnce sync.Once
+	sessionErr     error
+
+	presenceMu sync.Mutex
+	// users whose presence this connection is subscribed to
+	presenceTargets map[int]struct{}
+}
+
+func NewClient(session *Session, conn *websocket.Conn, hub *Hub) *Client {
+	return &Client{
+		id:         session.UserID,
+		connID:     uuid.NewString(),
+		conn:       conn,
+		queue:      newSendQueue(hub.sendQueueSize, hub.sendQueuePolicy),
+		hub:        hub,
+		log:        slog.Default(),
+		resync:     make(chan struct{}),
+		shutdown:   make(chan struct{}),
+		session:    *session,
+		reauthed:   make(chan struct{}, 1),
+		sessionEnd: make(chan struct{}),
+
+		presenceTargets: make(map[int]struct{}),
+	}
+}
+
+// addPresenceTargets records new subscriptions and returns the ones not held yet.
+// Nothing is recorded if the connection would end up with more than limit.
+func (c *Client) addPresenceTargets(userIDs []int, limit int) ([]int, bool) {
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+
+	added := make([]int, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if _, ok := c.presenceTargets[userID]; !ok && !slices.Contains(added, userID) {
+			added = append(added, userID)
+		}
+	}
+	if len(c.presenceTargets)+len(added) > limit {
+		return nil, false
+	}
+
+	for _, userID := range added {
+		c.presenceTargets[userID] = struct{}{}
+	}
+	return added, true
 }
 
-func NewClient(id int, conn *websocket.Conn, hub *Hub) *Client {
-	client := &Client{
-		id:   id,
-		conn: conn,
-		hub:  hub,
+// removePresenceTargets drops subscriptions and returns the ones that were held.
+func (c *Client) removePresenceTargets(userIDs []int) []int {
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+
+	removed := make([]int, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if _, ok := c.presenceTargets[userID]; ok {
+			delete(c.presenceTargets, userID)
+			removed = append(removed, userID)
+		}
+	}
+	return removed
+}
+
+func (c *Client) allPresenceTargets() []int {
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+
+	return slices.Collect(maps.Keys(c.presenceTargets))
+}
+
+func (c *Client) currentSession() Session {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	return c.session
+}
+
+func (c *Client) setSession(session *Session) {
+	c.sessionMu.Lock()
+	c.session = *session
+	c.sessionMu.Unlock()
+
+	select {
+	case c.reauthed <- struct{}{}:
+	default:
+	}
+}
+
+// endSession makes the writer flush queued events and close the connection with the code for err.
+func (c *Client) endSession(err error) {
+	c.sessionEndOnce.Do(func() {
+		c.sessionErr = err
+		close(c.sessionEnd)
+	})
+}
+
+func (c *Client) enqueue(msg *ProduceMessage) {
+	if c.queue.push(msg) {
+		return
 	}
 
-	hub.register <- client
-	return client
+	c.resyncOnce.Do(func() {
+		metrics.SendQueueOverflows.Inc()
+		c.log.Warn("Client send queue overflowed, disconnecting", "type", msg.Type)
+		close(c.resync)
+	})
+}
+
+// goAway makes the writer flush queued events and close the connection with CloseGoingAway.
+func (c *Client) goAway() {
+	c.shutdownOnce.Do(func() {
+		close(c.shutdown)
+	})
+}
+
+func (c *Client) writeClose(code int, text string) {
+	closeMsg := websocket.FormatCloseMessage(code, text)
+	if err := c.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(writeWait)); err != nil {
+		c.log.Error("Failed to write close message", "error", err)
+	}
 }
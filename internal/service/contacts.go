@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/ReilBleem13/MessangerV2/internal/logger"
+)
+
+func (us *UserService) GetContacts(ctx context.Context, userID int) ([]domain.UserSummary, error) {
+	contacts, err := us.userRepo.GetContacts(ctx, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get contacts", "error", err)
+		return nil, err
+	}
+	return contacts, nil
+}
+
+func (us *UserService) RemoveContact(ctx context.Context, userID, contactID int) error {
+	removed, err := us.userRepo.RemoveContact(ctx, userID, contactID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to remove contact", "contact_id", contactID, "error", err)
+		return err
+	}
+	if !removed {
+		return domain.ErrNotFound.WithMessage("Contact not found")
+	}
+
+	us.publishContactEvent(ctx, domain.ContactRemovedType, []int{userID, contactID}, &ContactRemovedEvent{
+		UserID:    userID,
+		ContactID: contactID,
+	})
+	return nil
+}
+
+func (us *UserService) GetContactRequests(ctx context.Context, userID int) (incoming, outgoing []domain.ContactRequest, err error) {
+	requests, err := us.userRepo.GetContactRequests(ctx, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get contact requests", "error", err)
+		return nil, nil, err
+	}
+
+	incoming = make([]domain.ContactRequest, 0, len(requests))
+	outgoing = make([]domain.ContactRequest, 0, len(requests))
+	for _, request := range requests {
+		if request.ToUserID == userID {
+			incoming = append(incoming, request)
+		} else {
+			outgoing = append(outgoing, request)
+		}
+	}
+	return incoming, outgoing, nil
+}
+
+// SendContactRequest asks toID to become a contact. If toID already asked fromID, their request is
+// accepted instead and the returned bool is true.
+func (us *UserService) SendContactRequest(ctx context.Context, fromID, toID int) (*domain.ContactRequest, bool, error) {
+	if fromID == toID {
+		return nil, false, domain.ErrInvalidRequest.WithMessage("Can't add yourself to contacts")
+	}
+
+	if err := us.checkContactRequest(ctx, fromID, toID); err != nil {
+		return nil, false, err
+	}
+
+	request, err := us.userRepo.AcceptContactRequest(ctx, toID, fromID)
+	if err == nil {
+		us.publishContactRequest(ctx, domain.ContactRequestAcceptedType, request)
+		return request, true, nil
+	}
+
+	var appErr *domain.AppError
+	if !errors.As(err, &appErr) || appErr.Code != domain.ErrNotFound.Code {
+		logger.FromContext(ctx).Error("Failed to accept contact request", "from_user_id", toID, "error", err)
+		return nil, false, err
+	}
+
+	request, err = us.userRepo.CreateContactRequest(ctx, fromID, toID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create contact request", "to_user_id", toID, "error", err)
+		return nil, false, err
+	}
+
+	us.publishContactRequest(ctx, domain.ContactRequestType, request)
+	return request, false, nil
+}
+
+func (us *UserService) checkContactRequest(ctx context.Context, fromID, toID int) error {
+	blocked, err := us.userRepo.IsBlocked(ctx, toID, fromID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to check block", "error", err)
+		return err
+	}
+	if blocked {
+		return domain.ErrBlocked
+	}
+
+	blocked, err = us.userRepo.IsBlocked(ctx, fromID, toID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to check block", "error", err)
+		return err
+	}
+	if blocked {
+		return domain.ErrInvalidRequest.WithMessage("Unblock the user first")
+	}
+
+	isContact, err := us.userRepo.AreContacts(ctx, fromID, toID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to check contacts", "error", err)
+		return err
+	}
+	if isContact {
+		return domain.ErrAlreadyExists.WithMessage("User is already a contact")
+	}
+	return nil
+}
+
+func (us *UserService) AcceptContactRequest(ctx context.Context, userID, fromID int) (*domain.ContactRequest, error) {
+	request, err := us.userRepo.AcceptContactRequest(ctx, fromID, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to accept contact request", "from_user_id", fromID, "error", err)
+		return nil, err
+	}
+
+	us.publishContactRequest(ctx, domain.ContactRequestAcceptedType, request)
+	return request, nil
+}
+
+func (us *UserService) DeclineContactRequest(ctx context.Context, userID, fromID int) error {
+	request, err := us.userRepo.DeleteContactRequest(ctx, fromID, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to decline contact request", "from_user_id", fromID, "error", err)
+		return err
+	}
+
+	us.publishContactRequest(ctx, domain.ContactRequestDeclinedType, request)
+	return nil
+}
+
+func (us *UserService) CancelContactRequest(ctx context.Context, userID, toID int) error {
+	request, err := us.userRepo.DeleteContactRequest(ctx, userID, toID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to cancel contact request", "to_user_id", toID, "error", err)
+		return err
+	}
+
+	us.publishContactRequest(ctx, domain.ContactRequestCancelledType, request)
+	return nil
+}
+
+// publishContactRequest notifies both sides, the user's other sessions included.
+func (us *UserService) publishContactRequest(ctx context.Context, eventType domain.EventType, request *domain.ContactRequest) {
+	us.publishContactEvent(ctx, eventType, []int{request.FromUserID, request.ToUserID}, &ContactRequestEvent{
+		Request: request,
+	})
+}
+
+func (us *UserService) publishContactEvent(ctx context.Context, eventType domain.EventType, userIDs []int, event any) {
+	eventByte, err := json.Marshal(event)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to marshal data", "error", err)
+		return
+	}
+
+	us.hub.broadcast(ctx, userIDs, &ProduceMessage{
+		Type: eventType,
+		Data: eventByte,
+	})
+}
@@ -42,6 +42,44 @@ type SendMarkAsDeliveredRequest struct {
 type ProduceMessage struct {
 	Type domain.EventType `json:"type"`
 	Data json.RawMessage  `json:"data,omitempty"`
+
+	// W3C trace context of the producer, stripped before writing to the client
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+}
+
+// Events forwarded between nodes for users connected elsewhere
+type NodeEnvelope struct {
+	UserIDs []int           `json:"user_ids"`
+	Message *ProduceMessage `json:"message"`
+	SentAt  time.Time       `json:"sent_at"`
+}
+
+type ContactRequestEvent struct {
+	Request *domain.ContactRequest `json:"request"`
+}
+
+// UserID removed ContactID
+type ContactRemovedEvent struct {
+	UserID    int `json:"user_id"`
+	ContactID int `json:"contact_id"`
+}
+
+type ProfileUpdatedEvent struct {
+	Profile *domain.UserProfile `json:"profile"`
+}
+
+// token_expiring and reauthenticated
+type SessionEvent struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type ErrorEvent struct {
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	FrameType    string `json:"frame_type,omitempty"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
+	// set when a send_message frame was rejected
+	TempMessageID string `json:"temp_message_id,omitempty"`
 }
 
 type MessageConfirmedEvent struct {
@@ -57,6 +95,10 @@ type PresenceEvent struct {
 	UserID    int       `json:"user_id"`
 	Presence  bool      `json:"presence"`
 	Timestamp time.Time `json:"timestamp"`
+	// set when going offline unless hidden by the user's privacy settings
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+	// set on status changes, empty when the status was cleared
+	Status *domain.UserStatus `json:"status,omitempty"`
 }
 
 type ReadMessageEvent struct {
@@ -112,11 +154,41 @@ type GroupChangeMemberStatusEvent struct {
 	UserID    int `json:"user_id"`
 }
 
+type MembersAddedEvent struct {
+	MessageID int   `json:"message_id"`
+	GroupID   int   `json:"group_id"`
+	AddedByID int   `json:"added_by_id"`
+	UserIDs   []int `json:"user_ids"`
+}
+
+type ChatUpdatedEvent struct {
+	Chat        *domain.UserChat `json:"chat"`
+	UpdatedByID int              `json:"updated_by_id"`
+	Messages    []domain.Message `json:"messages"`
+}
+
 type ChangeListOfGroupsEvent struct {
 	GroupID int `json:"group_id"`
 }
 
 // DTOs
+// nil fields are left unchanged, empty description or avatar removes it
+type UpdateGroupChatDTO struct {
+	ChatID      int
+	UserID      int
+	Name        *string
+	Description *string
+	AvatarURL   *string
+}
+
+type UpdatedGroupChat struct {
+	Chat *domain.UserChat
+	// system messages, one per changed field
+	Messages []domain.Message
+	// set when the avatar was replaced or removed
+	OldAvatarURL *string
+}
+
 type GroupMemberDTO struct {
 	GroupID   int
 	SubjectID int
@@ -137,6 +209,72 @@ type PaginateMessagesDTO struct {
 	Cursor *int
 }
 
+type PaginateChatMembersDTO struct {
+	UserID int
+	ChatID int
+	Cursor *int
+	Limit  int
+	Query  *string
+	Role   *domain.GroupMemberRole
+}
+
+// Authenticated user of a connection, taken from the access token
+type Session struct {
+	UserID    int       `json:"user_id"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// presence_subscribe and presence_unsubscribe
+type PresenceSubscriptionRequest struct {
+	Type    domain.EventType `json:"type"`
+	UserIDs []int            `json:"user_ids"`
+}
+
+type PresenceSnapshotEvent struct {
+	Users []PresenceEvent `json:"users"`
+}
+
+type ReauthRequest struct {
+	Type  domain.EventType `json:"type"`
+	Token string           `json:"token"`
+}
+
+// nil fields are left unchanged, empty strings clear the field
+type UpdateProfileDTO struct {
+	About       *string
+	Experience  *string
+	GithubURL   *string
+	LinkedinURL *string
+	TwitterURL  *string
+	TelegramURL *string
+	WebsiteURL  *string
+	// whether the user shows up in search
+	Discoverable *bool
+}
+
+// nil fields are left unchanged
+type UpdatePrivacyDTO struct {
+	OnlineStatus *domain.PrivacyLevel
+	LastSeen     *domain.PrivacyLevel
+	GroupInvites *domain.PrivacyLevel
+	PrivateChats *domain.PrivacyLevel
+}
+
+type SearchUsersDTO struct {
+	UserID int
+	Query  string
+	// offset into the ranked results
+	Cursor *int
+	Limit  int
+}
+
+// Token bucket: Rate tokens per second, up to Burst at once
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
 // Response
 type OnlineUsersWithLastTimestamp struct {
 	UserID     int
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+
+	"github.com/ReilBleem13/MessangerV2/internal/logger"
+	"github.com/ReilBleem13/MessangerV2/internal/metrics"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// recipients resolved and published per hub call
+	fanOutBatchSize = 500
+	// pipelines in flight at once for very large chats
+	fanOutConcurrency = 8
+)
+
+// broadcast delivers msg to every connected user in userIDs. Local users get it straight from the hub,
+// node lookup and publishing for the rest are done with one round trip each per batch.
+func (h *Hub) broadcast(ctx context.Context, userIDs []int, msg *ProduceMessage) {
+	metrics.FanOutSize.Observe(float64(len(userIDs)))
+
+	if len(userIDs) <= fanOutBatchSize {
+		h.produceBatch(ctx, userIDs, msg)
+		return
+	}
+
+	var g errgroup.Group
+	g.SetLimit(fanOutConcurrency)
+
+	for start := 0; start < len(userIDs); start += fanOutBatchSize {
+		batch := userIDs[start:min(start+fanOutBatchSize, len(userIDs))]
+		g.Go(func() error {
+			h.produceBatch(ctx, batch, msg)
+			return nil
+		})
+	}
+	g.Wait()
+}
+
+func (h *Hub) produceBatch(ctx context.Context, userIDs []int, msg *ProduceMessage) {
+	if len(userIDs) == 0 {
+		return
+	}
+
+	if err := h.Publish(ctx, userIDs, msg); err != nil {
+		metrics.ProduceFailures.Inc()
+		logger.FromContext(ctx).Error("Failed to produce message batch",
+			"recipients", len(userIDs),
+			"type", msg.Type,
+			"error", err,
+		)
+	}
+}
+
+func excludeUser(userIDs []int, userID int) []int {
+	result := make([]int, 0, len(userIDs))
+	for _, id := range userIDs {
+		if id != userID {
+			result = append(result, id)
+		}
+	}
+	return result
+}
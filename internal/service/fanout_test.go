@@ -0,0 +1,119 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
+)
+
+// recipients are registered on a node the hub under test isn't, so everything goes through the repo
+const benchRemoteNodeID = "remote"
+
+var benchRecipientCounts = []int{10, 100, 1000, 5000}
+
+// The benchmarks below run against fakeFanOutRepo, they count repository round trips and the cost
+// of building envelopes. Redis latency is not part of the numbers.
+
+// fakeFanOutRepo keeps the user→node registry in memory and counts calls,
+// every call stands for one Redis round trip.
+type fakeFanOutRepo struct {
+	ConnectionRepoIn
+
+	nodes      map[int]string
+	roundTrips atomic.Int64
+}
+
+func newFakeFanOutRepo(userIDs []int) *fakeFanOutRepo {
+	repo := &fakeFanOutRepo{nodes: make(map[int]string, len(userIDs))}
+	for _, userID := range userIDs {
+		repo.nodes[userID] = benchRemoteNodeID
+	}
+	return repo
+}
+
+func (r *fakeFanOutRepo) GetUserNodes(ctx context.Context, userIDs []int) (map[int][]string, error) {
+	r.roundTrips.Add(1)
+
+	nodes := make(map[int][]string, len(userIDs))
+	for _, userID := range userIDs {
+		if nodeID, ok := r.nodes[userID]; ok {
+			nodes[userID] = []string{nodeID}
+		}
+	}
+	return nodes, nil
+}
+
+func (r *fakeFanOutRepo) PublishToNodes(ctx context.Context, envelopes map[string]*NodeEnvelope) error {
+	r.roundTrips.Add(1)
+	return nil
+}
+
+func benchRecipients(count int) []int {
+	userIDs := make([]int, count)
+	for i := range userIDs {
+		userIDs[i] = i + 1
+	}
+	return userIDs
+}
+
+func benchMessage() *ProduceMessage {
+	return &ProduceMessage{
+		Type: domain.NewMessageType,
+		Data: []byte(`{"chat_id":1,"message_id":1,"from_user_id":1,"content":"benchmark"}`),
+	}
+}
+
+// BenchmarkRoundTripsPerRecipient counts round trips when every recipient gets its own node lookup
+// and publish, the shape of fan-out before batching.
+func BenchmarkRoundTripsPerRecipient(b *testing.B) {
+	ctx := context.Background()
+	msg := benchMessage()
+
+	for _, count := range benchRecipientCounts {
+		b.Run(fmt.Sprintf("recipients=%d", count), func(b *testing.B) {
+			userIDs := benchRecipients(count)
+			repo := newFakeFanOutRepo(userIDs)
+
+			for b.Loop() {
+				for _, userID := range userIDs {
+					nodes, err := repo.GetUserNodes(ctx, []int{userID})
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					for _, nodeID := range nodes[userID] {
+						if err := repo.PublishToNodes(ctx, map[string]*NodeEnvelope{
+							nodeID: {UserIDs: []int{userID}, Message: msg, SentAt: time.Now()},
+						}); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			}
+			b.ReportMetric(float64(repo.roundTrips.Load())/float64(b.N), "roundtrips/op")
+		})
+	}
+}
+
+// BenchmarkRoundTripsBatched counts round trips of hub broadcast: batched node lookup and one publish per node.
+func BenchmarkRoundTripsBatched(b *testing.B) {
+	ctx := context.Background()
+	msg := benchMessage()
+
+	for _, count := range benchRecipientCounts {
+		b.Run(fmt.Sprintf("recipients=%d", count), func(b *testing.B) {
+			userIDs := benchRecipients(count)
+			repo := newFakeFanOutRepo(userIDs)
+			hub := NewHub("local", repo)
+
+			for b.Loop() {
+				hub.broadcast(ctx, userIDs, msg)
+			}
+			b.ReportMetric(float64(repo.roundTrips.Load())/float64(b.N), "roundtrips/op")
+		})
+	}
+}
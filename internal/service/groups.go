@@ -3,39 +3,151 @@ package service
 import (
 	"context"
 	"encoding/json"
-	"log/slog"
+	"fmt"
+	"slices"
 
 	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/ReilBleem13/MessangerV2/internal/logger"
 )
 
+// members that may be added together with the group
+const maxInitialGroupMembers = 200
+
 // GROUPS
-func (ms *MessageService) NewGroupChat(ctx context.Context, name string, authorID int) (int, error) {
-	groupID, err := ms.msgRepo.NewGroupChat(ctx, name, authorID)
+func (ms *MessageService) NewGroupChat(ctx context.Context, name string, authorID int, memberIDs []int) (int, error) {
+	name, err := normalizeGroupName(name)
 	if err != nil {
-		slog.Error("Failed to create new group chat", "error", err)
 		return 0, err
 	}
+
+	memberIDs = excludeUser(slices.Compact(slices.Sorted(slices.Values(memberIDs))), authorID)
+	if len(memberIDs) > maxInitialGroupMembers {
+		return 0, domain.ErrInvalidRequest.WithMessage("Too many members")
+	}
+
+	if err := ms.checkInitialGroupMembers(ctx, authorID, memberIDs); err != nil {
+		return 0, err
+	}
+
+	groupID, messageID, err := ms.msgRepo.NewGroupChat(ctx, name, authorID, memberIDs)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to create new group chat", "error", err)
+		return 0, err
+	}
+
+	if len(memberIDs) == 0 {
+		return groupID, nil
+	}
+
+	changeListOfGroupsEventByte, err := json.Marshal(&ChangeListOfGroupsEvent{
+		GroupID: groupID,
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to marshal data", "error", err)
+		return groupID, nil
+	}
+
+	for _, memberID := range memberIDs {
+		ms.handleProduce(ctx, memberID, &ProduceMessage{
+			Type: domain.InvitedToGroupChatType,
+			Data: changeListOfGroupsEventByte,
+		})
+	}
+
+	membersAddedEventByte, err := json.Marshal(&MembersAddedEvent{
+		MessageID: messageID,
+		GroupID:   groupID,
+		AddedByID: authorID,
+		UserIDs:   memberIDs,
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to marshal data", "error", err)
+		return groupID, nil
+	}
+
+	ms.hub.broadcast(ctx, append([]int{authorID}, memberIDs...), &ProduceMessage{
+		Type: domain.MembersAddedType,
+		Data: membersAddedEventByte,
+	})
 	return groupID, nil
 }
 
+// checkInitialGroupMembers allows only contacts of the author whose privacy settings let them be added.
+func (ms *MessageService) checkInitialGroupMembers(ctx context.Context, authorID int, memberIDs []int) error {
+	if len(memberIDs) == 0 {
+		return nil
+	}
+
+	contactIDs, err := ms.msgRepo.GetUserContacts(ctx, authorID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get user contacts", "error", err)
+		return err
+	}
+
+	contacts := make(map[int]struct{}, len(contactIDs))
+	for _, contactID := range contactIDs {
+		contacts[contactID] = struct{}{}
+	}
+	for _, memberID := range memberIDs {
+		if _, ok := contacts[memberID]; !ok {
+			return domain.ErrForbidden.WithMessage(fmt.Sprintf("User %d is not in your contacts", memberID))
+		}
+	}
+
+	settings, err := ms.userRepo.GetPrivacySettingsForUsers(ctx, memberIDs)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get privacy settings", "error", err)
+		return err
+	}
+
+	for _, memberID := range memberIDs {
+		memberSettings, ok := settings[memberID]
+		if !ok {
+			return domain.ErrNotFound.WithMessage(fmt.Sprintf("User %d not found", memberID))
+		}
+		if !memberSettings.GroupInvites.Allows(true) {
+			return domain.ErrForbidden.WithMessage(fmt.Sprintf("User %d doesn't allow you to add them to groups", memberID))
+		}
+	}
+	return nil
+}
+
 func (ms *MessageService) DeleteGroupChat(ctx context.Context, groupID, userID int) error {
-	if err := ms.msgRepo.DeleteGroupChat(ctx, userID, groupID); err != nil {
-		slog.Error("Failed to detele group chat", "error", err)
+	avatarURL, err := ms.msgRepo.DeleteGroupChat(ctx, groupID, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to detele group chat", "error", err)
 		return err
 	}
+
+	if avatarURL != nil {
+		ms.deleteAvatar(ctx, *avatarURL)
+	}
 	return nil
 }
 
 func (ms *MessageService) NewGroupMember(ctx context.Context, in *GroupMemberDTO) error {
-	slog.Debug("User trying to add other user to group chat",
+	logger.FromContext(ctx).Debug("User trying to add other user to group chat",
 		"subjectID", in.SubjectID,
 		"objectID", in.ObjectID,
 		"groupID", in.GroupID,
 	)
 
+	blocked, err := ms.userRepo.IsBlocked(ctx, in.ObjectID, in.SubjectID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to check block", "error", err)
+		return err
+	}
+	if blocked {
+		return domain.ErrBlocked
+	}
+
+	if err := ms.checkGroupInvitePrivacy(ctx, in.SubjectID, in.ObjectID); err != nil {
+		return err
+	}
+
 	messageID, err := ms.msgRepo.NewGroupChatMember(ctx, in.GroupID, in.ObjectID)
 	if err != nil {
-		slog.Error("Failed to create new group chat member", "error", err)
+		logger.FromContext(ctx).Error("Failed to create new group chat member", "error", err)
 		return err
 	}
 
@@ -46,7 +158,7 @@ func (ms *MessageService) NewGroupMember(ctx context.Context, in *GroupMemberDTO
 
 	changeListOfGroupsEventByte, err := json.Marshal(changeListOfGroupsEvent)
 	if err != nil {
-		slog.Error("Failed to marshal data", "error", err)
+		logger.FromContext(ctx).Error("Failed to marshal data", "error", err)
 		return nil
 	}
 
@@ -62,26 +174,22 @@ func (ms *MessageService) NewGroupMember(ctx context.Context, in *GroupMemberDTO
 		UserID:    in.ObjectID,
 	}
 
-	members, err := ms.msgRepo.GetAllChatMembers(ctx, in.GroupID)
+	memberIDs, err := ms.msgRepo.GetChatMemberIDs(ctx, in.GroupID)
 	if err != nil {
-		slog.Error("Failed to get all group chat members", "error", err)
+		logger.FromContext(ctx).Error("Failed to get all group chat members", "error", err)
 		return nil
 	}
 
 	newMemberEventByte, err := json.Marshal(newMemberEvent)
 	if err != nil {
-		slog.Error("Failed to marshal data", "error", err)
+		logger.FromContext(ctx).Error("Failed to marshal data", "error", err)
 		return nil
 	}
 
-	for _, member := range members {
-		if member.ID != in.ObjectID {
-			ms.handleProduce(ctx, member.ID, &ProduceMessage{
-				Type: domain.NewMemberType,
-				Data: newMemberEventByte,
-			})
-		}
-	}
+	ms.hub.broadcast(ctx, excludeUser(memberIDs, in.ObjectID), &ProduceMessage{
+		Type: domain.NewMemberType,
+		Data: newMemberEventByte,
+	})
 	return nil
 }
 
@@ -89,12 +197,12 @@ func (ms *MessageService) NewGroupMember(ctx context.Context, in *GroupMemberDTO
 func (ms *MessageService) DeleteGroupMember(ctx context.Context, in *GroupMemberDTO) error {
 	role, err := ms.msgRepo.GetGroupChatMemberRole(ctx, in.SubjectID, in.GroupID)
 	if err != nil {
-		slog.Error("Failed to get user role in group chat", "error", err)
+		logger.FromContext(ctx).Error("Failed to get user role in group chat", "error", err)
 		return err
 	}
 
 	if role != domain.AdminRole {
-		slog.Warn("Not admin trying to delete member",
+		logger.FromContext(ctx).Warn("Not admin trying to delete member",
 			"subject", in.SubjectID,
 			"object", in.ObjectID,
 		)
@@ -103,7 +211,7 @@ func (ms *MessageService) DeleteGroupMember(ctx context.Context, in *GroupMember
 
 	messageID, err := ms.msgRepo.DeleteGroupMember(ctx, in.GroupID, in.ObjectID, *in.Type)
 	if err != nil {
-		slog.Error("Failed to delete group chat member", "error", err)
+		logger.FromContext(ctx).Error("Failed to delete group chat member", "error", err)
 		return err
 	}
 
@@ -116,7 +224,7 @@ func (ms *MessageService) DeleteGroupMember(ctx context.Context, in *GroupMember
 
 		changeListOfGroupsEventByte, err := json.Marshal(changeListOfGroupsEvent)
 		if err != nil {
-			slog.Error("Failed to marshal data", "error", err)
+			logger.FromContext(ctx).Error("Failed to marshal data", "error", err)
 			return nil
 		}
 
@@ -132,47 +240,114 @@ func (ms *MessageService) DeleteGroupMember(ctx context.Context, in *GroupMember
 		UserID:    in.ObjectID,
 	}
 
-	members, err := ms.msgRepo.GetAllChatMembers(ctx, in.GroupID)
+	memberIDs, err := ms.msgRepo.GetChatMemberIDs(ctx, in.GroupID)
 	if err != nil {
-		slog.Error("Failed to get all group chat members", "error", err)
+		logger.FromContext(ctx).Error("Failed to get all group chat members", "error", err)
 		return err
 	}
 
 	kickedMemberEventByte, err := json.Marshal(deleteMemberEvent)
 	if err != nil {
-		slog.Error("Failed to marshal data", "error", err)
+		logger.FromContext(ctx).Error("Failed to marshal data", "error", err)
 		return nil
 	}
 
+	ms.hub.broadcast(ctx, excludeUser(memberIDs, in.ObjectID), &ProduceMessage{
+		Type: *in.Type,
+		Data: kickedMemberEventByte,
+	})
+	return nil
+}
+
+const (
+	defaultChatMembersLimit = 50
+	maxChatMembersLimit     = 200
+)
+
+// Online statuses for the whole page are resolved in a single Redis round trip
+func (ms *MessageService) PaginateGroupChatMembers(ctx context.Context, in *PaginateChatMembersDTO) ([]*domain.ChatMember, *int, bool, error) {
+	if in.Role != nil && *in.Role != domain.AdminRole && *in.Role != domain.MemberRole {
+		return nil, nil, false, domain.ErrInvalidRequest.WithMessage("Unknown member role")
+	}
+
+	if err := ms.requireChatMember(ctx, in.UserID, in.ChatID); err != nil {
+		return nil, nil, false, err
+	}
+
+	switch {
+	case in.Limit <= 0:
+		in.Limit = defaultChatMembersLimit
+	case in.Limit > maxChatMembersLimit:
+		in.Limit = maxChatMembersLimit
+	}
+
+	members, newCursor, hasMore, err := ms.msgRepo.PaginateChatMembers(ctx, in)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to paginate group chat members", "error", err)
+		return nil, nil, false, err
+	}
+
+	memberIDs := make([]int, len(members))
+	for i, member := range members {
+		memberIDs[i] = member.ID
+	}
+
+	online := ms.heartbeatService.AreUsersOnline(ctx, memberIDs)
 	for _, member := range members {
-		if member.ID != in.ObjectID {
-			ms.handleProduce(ctx, member.ID, &ProduceMessage{
-				Type: *in.Type,
-				Data: kickedMemberEventByte,
-			})
+		self := member.ID == in.UserID
+		member.IsOnline = (self || member.OnlinePrivacy.Allows(member.IsContact)) && online[member.ID]
+		if !self && !member.LastSeenPrivacy.Allows(member.IsContact) {
+			member.LastSeenAt = nil
 		}
 	}
+	return members, newCursor, hasMore, nil
+}
+
+// requireChatMember uses the cached member ids, so it costs no query for active chats.
+func (ms *MessageService) requireChatMember(ctx context.Context, userID, chatID int) error {
+	memberIDs, err := ms.msgRepo.GetChatMemberIDs(ctx, chatID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get all group chat members", "error", err)
+		return err
+	}
+
+	if !slices.Contains(memberIDs, userID) {
+		return domain.ErrForbidden.WithMessage("You are not a member of this chat")
+	}
 	return nil
 }
 
-// Implement a returned object of type user_id, nickname, status online
-func (ms *MessageService) GetAllGroupChatMembers(ctx context.Context, chatID int) ([]*domain.ChatMember, error) {
-	members, err := ms.msgRepo.GetAllChatMembers(ctx, chatID)
+// checkGroupInvitePrivacy enforces who may add objectID to group chats.
+func (ms *MessageService) checkGroupInvitePrivacy(ctx context.Context, subjectID, objectID int) error {
+	if subjectID == objectID {
+		return nil
+	}
+
+	settings, err := ms.userRepo.GetPrivacySettings(ctx, objectID)
 	if err != nil {
-		slog.Error("Failed to get all group chat members", "error", err)
-		return nil, err
+		logger.FromContext(ctx).Error("Failed to get privacy settings", "error", err)
+		return err
 	}
 
-	for _, member := range members {
-		member.IsOnline = ms.heartbeatService.IsUserOnline(ctx, member.ID)
+	isContact := false
+	if settings.GroupInvites == domain.PrivacyContacts {
+		isContact, err = ms.userRepo.AreContacts(ctx, subjectID, objectID)
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to check contacts", "error", err)
+			return err
+		}
 	}
-	return members, nil
+
+	if !settings.GroupInvites.Allows(isContact) {
+		return domain.ErrForbidden.WithMessage("User doesn't allow you to add them to groups")
+	}
+	return nil
 }
 
 func (ms *MessageService) GetUserChats(ctx context.Context, userID int) ([]domain.UserChat, error) {
 	chats, err := ms.msgRepo.GetUserChats(ctx, userID)
 	if err != nil {
-		slog.Error("Failed to get user group chats", "error", err)
+		logger.FromContext(ctx).Error("Failed to get user group chats", "error", err)
 		return nil, err
 	}
 	return chats, nil
@@ -181,12 +356,12 @@ func (ms *MessageService) GetUserChats(ctx context.Context, userID int) ([]domai
 func (ms *MessageService) ChangeGroupMemberRole(ctx context.Context, in *UpdateGroupMemberRoleDTO) error {
 	role, err := ms.msgRepo.GetGroupChatMemberRole(ctx, in.SubjectID, in.ChatID)
 	if err != nil {
-		slog.Error("Failed to get user role in group chat", "error", err)
+		logger.FromContext(ctx).Error("Failed to get user role in group chat", "error", err)
 		return err
 	}
 
 	if role != domain.AdminRole {
-		slog.Warn("Not admin trying to change member role",
+		logger.FromContext(ctx).Warn("Not admin trying to change member role",
 			"subject", in.SubjectID,
 			"object", in.ObjectID,
 			"role", string(in.Role),
@@ -195,16 +370,20 @@ func (ms *MessageService) ChangeGroupMemberRole(ctx context.Context, in *UpdateG
 	}
 
 	if err := ms.msgRepo.ChangeGroupChatMemberRole(ctx, in); err != nil {
-		slog.Error("Failed to change group member role", "error", err)
+		logger.FromContext(ctx).Error("Failed to change group member role", "error", err)
 		return err
 	}
 	return nil
 }
 
 func (ms *MessageService) PaginateMessages(ctx context.Context, in *PaginateMessagesDTO) ([]domain.Message, *int, bool, error) {
+	if err := ms.requireChatMember(ctx, in.UserID, in.ChatID); err != nil {
+		return nil, nil, false, err
+	}
+
 	messages, newCursor, hasMore, err := ms.msgRepo.PaginateMessages(ctx, in.ChatID, in.Cursor)
 	if err != nil {
-		slog.Error("Failed to paginate chat essages", "error", err)
+		logger.FromContext(ctx).Error("Failed to paginate chat essages", "error", err)
 		return nil, nil, false, err
 	}
 	return messages, newCursor, hasMore, err
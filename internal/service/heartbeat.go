@@ -3,11 +3,11 @@ package service
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"log/slog"
+	"slices"
 	"time"
 
 	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/ReilBleem13/MessangerV2/internal/logger"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -15,6 +15,10 @@ const (
 	defaultDelta                  = 5 * time.Second
 	defaultInterval               = pongWait
 	defaultOfflineScannerInterval = 15 * time.Second
+
+	offlineScannerLease = "offline-scanner"
+	// expired users handled per round trip
+	offlineScanBatch = 1000
 )
 
 type HeartbeatOption func(ho *HeartbeatService)
@@ -22,6 +26,8 @@ type HeartbeatOption func(ho *HeartbeatService)
 type HeartbeatService struct {
 	connRepo               ConnectionRepoIn
 	msgRepo                MessageRepoIn
+	userRepo               UserRepoIn
+	hub                    *Hub
 	offlineScannerInterval time.Duration
 	interval               time.Duration
 	delta                  time.Duration
@@ -45,11 +51,13 @@ func WithOfflineInterval(offlineScannerInterval time.Duration) HeartbeatOption {
 	}
 }
 
-func NewHeartbeatService(ctx context.Context, connRepo ConnectionRepoIn,
-	msgRepo MessageRepoIn, opts ...HeartbeatOption) HeartbeatServiceIn {
+func NewHeartbeatService(connRepo ConnectionRepoIn, msgRepo MessageRepoIn, userRepo UserRepoIn,
+	hub *Hub, opts ...HeartbeatOption) HeartbeatServiceIn {
 	hs := &HeartbeatService{
 		connRepo:               connRepo,
 		msgRepo:                msgRepo,
+		userRepo:               userRepo,
+		hub:                    hub,
 		interval:               defaultInterval,
 		delta:                  defaultDelta,
 		offlineScannerInterval: defaultOfflineScannerInterval,
@@ -59,10 +67,14 @@ func NewHeartbeatService(ctx context.Context, connRepo ConnectionRepoIn,
 		opt(hs)
 	}
 
-	go hs.offlineScanner(ctx)
 	return hs
 }
 
+// Run scans for users that stopped sending heartbeats until ctx is done.
+func (hs *HeartbeatService) Run(ctx context.Context) {
+	hs.offlineScanner(ctx)
+}
+
 func (hs *HeartbeatService) HandleHeartbeat(ctx context.Context, userID int) error {
 	now := time.Now()
 
@@ -77,87 +89,244 @@ func (hs *HeartbeatService) HandleHeartbeat(ctx context.Context, userID int) err
 	})
 
 	if wasOffline {
-		hs.notifyPresenceChange(ctx, userID, true)
+		hs.notifyPresenceChange(ctx, []int{userID}, true, nil)
 	}
 	return nil
 }
 
+// offlineScanner runs on one node at a time, the node holding the scanner lease.
+// It also clears custom statuses that expired since the last tick.
 func (hs *HeartbeatService) offlineScanner(ctx context.Context) {
 	ticker := time.NewTicker(hs.offlineScannerInterval)
 	defer ticker.Stop()
 
+	owner := hs.hub.NodeID()
+	// another node takes over within a few ticks if this one dies
+	leaseTTL := 3 * hs.offlineScannerInterval
+
+	defer func() {
+		if err := hs.connRepo.ReleaseLease(context.WithoutCancel(ctx), offlineScannerLease, owner); err != nil {
+			logger.FromContext(ctx).Warn("Failed to release offline scanner lease", "error", err)
+		}
+	}()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			hs.checkOfflineUsers(ctx)
+			acquired, err := hs.connRepo.AcquireLease(ctx, offlineScannerLease, owner, leaseTTL)
+			if err != nil {
+				logger.FromContext(ctx).Error("Failed to acquire offline scanner lease", "error", err)
+				continue
+			}
+			if acquired {
+				hs.checkOfflineUsers(ctx)
+				hs.clearExpiredStatuses(ctx)
+			}
 		}
 	}
 }
 
 func (hs *HeartbeatService) checkOfflineUsers(ctx context.Context) {
-	onlineUsersWithTimestamp, err := hs.connRepo.GetAllOnlineUsers(ctx)
+	before := time.Now().Add(-(hs.interval + 2*hs.delta))
+
+	for {
+		expired, err := hs.connRepo.GetExpiredOnlineUsers(ctx, before, offlineScanBatch)
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to get expired online users", "error", err)
+			return
+		}
+		if len(expired) == 0 {
+			return
+		}
+
+		lastSeen := make(map[int]time.Time, len(expired))
+		userIDs := make([]int, len(expired))
+		for i, user := range expired {
+			lastSeen[user.UserID] = user.Timestampt
+			userIDs[i] = user.UserID
+		}
+
+		// persisted before the users are removed, if this fails they are retried on the next scan
+		if err := hs.userRepo.SetLastSeen(ctx, lastSeen); err != nil {
+			logger.FromContext(ctx).Error("Failed to persist last seen", "users", len(lastSeen), "error", err)
+			return
+		}
+
+		// users that sent a heartbeat since the range query stay online
+		removed, err := hs.connRepo.RemoveExpiredOnlineUsers(ctx, userIDs, before)
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to remove expired online users", "error", err)
+			return
+		}
+
+		hs.notifyPresenceChange(ctx, removed, false, lastSeen)
+		logger.FromContext(ctx).Debug("Users went offline", "users", len(removed))
+
+		if len(expired) < offlineScanBatch {
+			return
+		}
+	}
+}
+
+// notifyPresenceChange tells everyone interested that userIDs went online or offline.
+// lastSeen is only used when going offline.
+func (hs *HeartbeatService) notifyPresenceChange(ctx context.Context, userIDs []int, isOnline bool, lastSeen map[int]time.Time) {
+	audiences, err := hs.getInterestedUsers(ctx, userIDs, isOnline)
 	if err != nil {
-		slog.Error("Failed to get online users", "error", err)
+		logger.FromContext(ctx).Error("Failed to get interested users", "users", len(userIDs), "error", err)
 		return
 	}
 
 	now := time.Now()
-	threshold := hs.interval + 2*hs.delta
+	for userID, audience := range audiences {
+		event := PresenceEvent{
+			UserID:    userID,
+			Presence:  isOnline,
+			Timestamp: now,
+		}
+		hs.publishPresence(ctx, audience.withoutLastSeen, &event)
 
-	for _, user := range onlineUsersWithTimestamp {
-		if now.Sub(user.Timestampt) > threshold {
-			hs.connRepo.DeleteOnlineStatus(ctx, user.UserID)
-			hs.notifyPresenceChange(ctx, user.UserID, false)
-			slog.Debug("User went offline", "user_id", user.UserID)
+		if lastSeenAt, ok := lastSeen[userID]; ok {
+			event.LastSeenAt = &lastSeenAt
 		}
+		hs.publishPresence(ctx, audience.withLastSeen, &event)
 	}
 }
 
-func (hs *HeartbeatService) notifyPresenceChange(ctx context.Context, userID int, isOnline bool) {
-	interestedUsers, err := hs.getInterestedUsers(ctx, userID)
+// PublishStatus sends a status change to the same users that see the user's presence.
+func (hs *HeartbeatService) PublishStatus(ctx context.Context, userID int, status *domain.UserStatus) {
+	hs.publishStatuses(ctx, []int{userID}, status)
+}
+
+func (hs *HeartbeatService) publishStatuses(ctx context.Context, userIDs []int, status *domain.UserStatus) {
+	// treated as going online so nobody is sent the last seen time
+	audiences, err := hs.getInterestedUsers(ctx, userIDs, true)
 	if err != nil {
-		slog.Error("Failed to get interested users")
+		logger.FromContext(ctx).Error("Failed to get interested users", "users", len(userIDs), "error", err)
+		return
+	}
+	if len(audiences) == 0 {
+		return
 	}
 
-	marshalData, err := json.Marshal(PresenceEvent{
-		UserID:    userID,
-		Presence:  isOnline,
-		Timestamp: time.Now(),
-	})
+	online := hs.AreUsersOnline(ctx, userIDs)
+	now := time.Now()
+	for userID, audience := range audiences {
+		hs.publishPresence(ctx, audience.withoutLastSeen, &PresenceEvent{
+			UserID:    userID,
+			Presence:  online[userID],
+			Timestamp: now,
+			Status:    status,
+		})
+	}
+}
+
+func (hs *HeartbeatService) clearExpiredStatuses(ctx context.Context) {
+	userIDs, err := hs.userRepo.ClearExpiredStatuses(ctx)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to clear expired statuses", "error", err)
+		return
+	}
 
-	msg := &ProduceMessage{
+	hs.publishStatuses(ctx, userIDs, &domain.UserStatus{})
+}
+
+func (hs *HeartbeatService) publishPresence(ctx context.Context, userIDs []int, event *PresenceEvent) {
+	if len(userIDs) == 0 {
+		return
+	}
+
+	marshalData, err := json.Marshal(event)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to marshal data", "error", err)
+		return
+	}
+
+	hs.hub.broadcast(ctx, userIDs, &ProduceMessage{
 		Type: domain.PresenceChangeType,
 		Data: marshalData,
+	})
+}
+
+// presenceAudience is who sees a presence change of one user, split by whether they may also
+// see the last seen time. withLastSeen is empty when going online.
+type presenceAudience struct {
+	withLastSeen    []int
+	withoutLastSeen []int
+}
+
+// getInterestedUsers returns, for each of userIDs, the contacts and presence subscribers its privacy
+// settings let see the change. Every relation is loaded with one query for the whole batch.
+// Users hidden from everyone or without anyone to tell are absent from the result.
+func (hs *HeartbeatService) getInterestedUsers(ctx context.Context, userIDs []int, isOnline bool) (map[int]*presenceAudience, error) {
+	result := make(map[int]*presenceAudience)
+	if len(userIDs) == 0 {
+		return result, nil
 	}
 
-	for _, recipientID := range interestedUsers {
-		channel := fmt.Sprintf("message:%d", recipientID)
-		hs.connRepo.Produce(ctx, channel, msg)
+	settings, err := hs.userRepo.GetPrivacySettingsForUsers(ctx, userIDs)
+	if err != nil {
+		return nil, err
 	}
-}
 
-func (hs *HeartbeatService) getInterestedUsers(ctx context.Context, userID int) ([]int, error) {
-	ids, err := hs.msgRepo.GetUserContacts(ctx, userID)
+	visible := make([]int, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if userSettings, ok := settings[userID]; ok && userSettings.OnlineStatus != domain.PrivacyNobody {
+			visible = append(visible, userID)
+		}
+	}
+	if len(visible) == 0 {
+		return result, nil
+	}
+
+	subscribers, err := hs.connRepo.GetPresenceSubscribers(ctx, visible)
 	if err != nil {
-		slog.Error("Failed to get all user contacts", "error", err)
 		return nil, err
 	}
 
-	result := []int{}
-	now := time.Now()
+	contactIDs, err := hs.msgRepo.GetContactsOfUsers(ctx, visible)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, id := range ids {
-		timestamp, err := hs.connRepo.GetOnlineStatus(ctx, id)
-		if err != nil {
-			slog.Error("Failed to get online status", "error", err)
-			continue
+	// users blocked by a user don't see their presence
+	blockedIDs, err := hs.userRepo.GetBlockedUserIDs(ctx, visible)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, userID := range visible {
+		userSettings := settings[userID]
+
+		contacts := make(map[int]bool, len(contactIDs[userID]))
+		for _, id := range contactIDs[userID] {
+			contacts[id] = true
+		}
+
+		recipients := slices.Clone(contactIDs[userID])
+		for _, id := range subscribers[userID] {
+			if !contacts[id] {
+				recipients = append(recipients, id)
+			}
 		}
 
-		threshold := hs.interval + 2*hs.delta
-		if now.Sub(timestamp) < threshold {
-			result = append(result, id)
+		audience := &presenceAudience{}
+		for _, id := range recipients {
+			if slices.Contains(blockedIDs[userID], id) || !userSettings.OnlineStatus.Allows(contacts[id]) {
+				continue
+			}
+
+			if !isOnline && userSettings.LastSeen.Allows(contacts[id]) {
+				audience.withLastSeen = append(audience.withLastSeen, id)
+			} else {
+				audience.withoutLastSeen = append(audience.withoutLastSeen, id)
+			}
+		}
+
+		if len(audience.withLastSeen) > 0 || len(audience.withoutLastSeen) > 0 {
+			result[userID] = audience
 		}
 	}
 	return result, nil
@@ -170,3 +339,19 @@ func (hs *HeartbeatService) IsUserOnline(ctx context.Context, userID int) bool {
 	}
 	return time.Since(lastActive) <= (hs.interval + 2*hs.delta)
 }
+
+func (hs *HeartbeatService) AreUsersOnline(ctx context.Context, userIDs []int) map[int]bool {
+	result := make(map[int]bool, len(userIDs))
+
+	statuses, err := hs.connRepo.GetOnlineStatuses(ctx, userIDs)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get online statuses", "error", err)
+		return result
+	}
+
+	threshold := hs.interval + 2*hs.delta
+	for userID, lastActive := range statuses {
+		result[userID] = time.Since(lastActive) <= threshold
+	}
+	return result
+}
@@ -1,38 +1,245 @@
 package service
 
-import "log/slog"
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
 
-var hub = NewHub()
+	"github.com/ReilBleem13/MessangerV2/internal/logger"
+	"github.com/ReilBleem13/MessangerV2/internal/metrics"
+	"github.com/ReilBleem13/MessangerV2/internal/tracing"
+)
 
+// how long a user→node mapping lives without heartbeats
+const userNodeTTL = 3 * pongWait
+
+// Hub delivers events to clients connected to this node directly and forwards events for users
+// connected elsewhere to their node's channel. Every node subscribes only to its own channel,
+// the user→node registry in Redis tells which node that is.
 type Hub struct {
-	clients map[int]*Client
+	nodeID   string
+	connRepo ConnectionRepoIn
+
+	sendQueueSize   int
+	sendQueuePolicy QueuePolicy
 
-	register   chan *Client
-	unregister chan *Client
+	running atomic.Bool
+
+	mu sync.RWMutex
+	// a user may have several connections open, each of them gets every event
+	clients  map[int]map[*Client]struct{}
+	draining bool
+	// tracks live connections so Drain can wait for them
+	conns sync.WaitGroup
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		clients:    make(map[int]*Client),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
+type HubOption func(h *Hub)
+
+// WithSendQueue sets capacity and overflow policy of every client's outbound queue.
+func WithSendQueue(size int, policy QueuePolicy) HubOption {
+	return func(h *Hub) {
+		if size > 0 {
+			h.sendQueueSize = size
+		}
+		if policy != "" {
+			h.sendQueuePolicy = policy
+		}
 	}
 }
 
-func GetHub() *Hub {
-	return hub
+func NewHub(nodeID string, connRepo ConnectionRepoIn, opts ...HubOption) *Hub {
+	h := &Hub{
+		nodeID:          nodeID,
+		connRepo:        connRepo,
+		sendQueueSize:   defaultSendQueueSize,
+		sendQueuePolicy: DropEphemeralPolicy,
+		clients:         make(map[int]map[*Client]struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+func (h *Hub) NodeID() string {
+	return h.nodeID
 }
 
-func (h *Hub) Run() {
+// Run receives events forwarded by other nodes until ctx is done.
+func (h *Hub) Run(ctx context.Context) {
+	pubSub := h.connRepo.SubscribeNode(ctx, h.nodeID)
+	defer pubSub.Close()
+
+	h.running.Store(true)
+	defer h.running.Store(false)
+
+	logger.FromContext(ctx).Info("Hub is running", "node_id", h.nodeID)
+
+	ch := pubSub.Channel()
 	for {
 		select {
-		case client := <-h.register:
-			h.clients[client.id] = client
-			slog.Info("User Connected", "user_id", client.id)
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+
+			var envelope NodeEnvelope
+			if err := json.Unmarshal([]byte(msg.Payload), &envelope); err != nil {
+				logger.FromContext(ctx).Error("Failed to unmarshal node envelope", "error", err)
+				continue
+			}
+			metrics.PubSubLag.Observe(time.Since(envelope.SentAt).Seconds())
+			h.deliverLocal(envelope.UserIDs, envelope.Message)
+		}
+	}
+}
+
+// register returns false if the node is draining and the client must go away right away.
+func (h *Hub) register(ctx context.Context, client *Client) bool {
+	h.mu.Lock()
+	if h.draining {
+		h.mu.Unlock()
+		return false
+	}
+	userClients, ok := h.clients[client.id]
+	if !ok {
+		userClients = make(map[*Client]struct{})
+		h.clients[client.id] = userClients
+	}
+	userClients[client] = struct{}{}
+	h.conns.Add(1)
+	h.mu.Unlock()
+
+	if err := h.connRepo.SetUserNode(ctx, client.id, h.nodeID, userNodeTTL); err != nil {
+		logger.FromContext(ctx).Error("Failed to register user node", "user_id", client.id, "error", err)
+	}
+	logger.FromContext(ctx).Info("User Connected", "user_id", client.id, "node_id", h.nodeID)
+	return true
+}
+
+func (h *Hub) unregister(ctx context.Context, client *Client) {
+	defer h.conns.Done()
+
+	h.mu.Lock()
+	userClients := h.clients[client.id]
+	delete(userClients, client)
+	// other connections of the user keep the node registered
+	lastOnNode := len(userClients) == 0
+	if lastOnNode {
+		delete(h.clients, client.id)
+	}
+	h.mu.Unlock()
+
+	if lastOnNode {
+		if err := h.connRepo.DeleteUserNode(ctx, client.id, h.nodeID); err != nil {
+			logger.FromContext(ctx).Error("Failed to unregister user node", "user_id", client.id, "error", err)
+		}
+	}
+	logger.FromContext(ctx).Info("User disconnected", "user_id", client.id)
+}
+
+// Running reports whether the Run loop is alive.
+func (h *Hub) Running() bool {
+	return h.running.Load()
+}
+
+// Draining reports whether the node stopped accepting new connections.
+func (h *Hub) Draining() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.draining
+}
+
+// Drain asks every connected client to reconnect elsewhere and waits until all of them
+// flushed their queues and disconnected or ctx is done.
+func (h *Hub) Drain(ctx context.Context) error {
+	h.mu.Lock()
+	h.draining = true
+	for _, userClients := range h.clients {
+		for client := range userClients {
+			client.goAway()
+		}
+	}
+	h.mu.Unlock()
+
+	return h.Wait(ctx)
+}
+
+// Wait blocks until every connection handler returned or ctx is done.
+func (h *Hub) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.conns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// refresh extends the user→node mapping, called on every heartbeat.
+func (h *Hub) refresh(ctx context.Context, client *Client) {
+	if err := h.connRepo.SetUserNode(ctx, client.id, h.nodeID, userNodeTTL); err != nil {
+		logger.FromContext(ctx).Error("Failed to refresh user node", "user_id", client.id, "error", err)
+	}
+}
+
+// Publish delivers msg to every user in userIDs that is connected to any node.
+// Offline users are skipped.
+func (h *Hub) Publish(ctx context.Context, userIDs []int, msg *ProduceMessage) error {
+	if msg.TraceContext == nil {
+		// copy, the same message may be published concurrently for other batches
+		traced := *msg
+		traced.TraceContext = tracing.Inject(ctx)
+		msg = &traced
+	}
+
+	h.deliverLocal(userIDs, msg)
+
+	// users connected here may have connections on other nodes too
+	nodes, err := h.connRepo.GetUserNodes(ctx, userIDs)
+	if err != nil {
+		return err
+	}
+
+	envelopes := make(map[string]*NodeEnvelope)
+	for _, userID := range userIDs {
+		for _, nodeID := range nodes[userID] {
+			if nodeID == h.nodeID {
+				continue
+			}
+
+			envelope, ok := envelopes[nodeID]
+			if !ok {
+				envelope = &NodeEnvelope{
+					Message: msg,
+					SentAt:  time.Now(),
+				}
+				envelopes[nodeID] = envelope
+			}
+			envelope.UserIDs = append(envelope.UserIDs, userID)
+		}
+	}
+	return h.connRepo.PublishToNodes(ctx, envelopes)
+}
+
+// deliverLocal hands msg to every connection of userIDs on this node.
+func (h *Hub) deliverLocal(userIDs []int, msg *ProduceMessage) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 
-		case client := <-h.unregister:
-			delete(h.clients, client.id)
-			slog.Info("User disconnected", "user_id", client.id)
+	for _, userID := range userIDs {
+		for client := range h.clients[userID] {
+			client.enqueue(msg)
 		}
 	}
 }
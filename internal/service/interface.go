@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"io"
 	"time"
 
 	"github.com/ReilBleem13/MessangerV2/internal/domain"
@@ -18,46 +19,143 @@ type MessageRepoIn interface {
 	SetDeliveredAtStatus(ctx context.Context, messageID, userID int) error
 	SetReadAtStatus(ctx context.Context, upToID, chatID, userID int) error
 
-	NewGroupChat(ctx context.Context, name string, authorID int) (int, error)
-	DeleteGroupChat(ctx context.Context, chatID, authorID int) error
+	NewGroupChat(ctx context.Context, name string, authorID int, memberIDs []int) (int, int, error)
+	DeleteGroupChat(ctx context.Context, chatID, authorID int) (*string, error)
+	UpdateGroupChat(ctx context.Context, in *UpdateGroupChatDTO) (*UpdatedGroupChat, error)
 
 	GetOrCreatePrivateChat(ctx context.Context, userID1, userID2 int) (int, bool, error)
+	HasPrivateChat(ctx context.Context, userID1, userID2 int) (bool, error)
 	NewGroupChatMember(ctx context.Context, chatID, userID int) (int, error)
 	DeleteGroupMember(ctx context.Context, chatID, userID int, typeDelete domain.EventType) (int, error)
-	GetAllChatMembers(ctx context.Context, chatID int) ([]*domain.ChatMember, error)
+	GetChatMemberIDs(ctx context.Context, chatID int) ([]int, error)
+	PaginateChatMembers(ctx context.Context, in *PaginateChatMembersDTO) ([]*domain.ChatMember, *int, bool, error)
 	GetGroupChatMemberRole(ctx context.Context, userID, chatID int) (domain.GroupMemberRole, error)
 	ChangeGroupChatMemberRole(ctx context.Context, in *UpdateGroupMemberRoleDTO) error
 
 	GetUserChats(ctx context.Context, userID int) ([]domain.UserChat, error)
 	GetUserContacts(ctx context.Context, userID int) ([]int, error)
+	GetContactsOfUsers(ctx context.Context, userIDs []int) (map[int][]int, error)
 }
 
 type ConnectionRepoIn interface {
-	Subscribe(ctx context.Context, userID int) *redis.PubSub
-	Produce(ctx context.Context, channel string, msg *ProduceMessage) error
+	SubscribeNode(ctx context.Context, nodeID string) *redis.PubSub
+	PublishToNodes(ctx context.Context, envelopes map[string]*NodeEnvelope) error
+
+	SetUserNode(ctx context.Context, userID int, nodeID string, ttl time.Duration) error
+	DeleteUserNode(ctx context.Context, userID int, nodeID string) error
+	GetUserNodes(ctx context.Context, userIDs []int) (map[int][]string, error)
 
 	UpdateOnlineStatus(ctx context.Context, in *PresenceEvent) error
 	GetOnlineStatus(ctx context.Context, userID int) (time.Time, error)
+	GetOnlineStatuses(ctx context.Context, userIDs []int) (map[int]time.Time, error)
+
+	GetExpiredOnlineUsers(ctx context.Context, before time.Time, limit int) ([]OnlineUsersWithLastTimestamp, error)
+	RemoveExpiredOnlineUsers(ctx context.Context, userIDs []int, before time.Time) ([]int, error)
+
+	AddPresenceSubscriptions(ctx context.Context, userID int, connID string, targetIDs []int) error
+	RemovePresenceSubscriptions(ctx context.Context, userID int, connID string, targetIDs []int) error
+	GetPresenceSubscribers(ctx context.Context, targetIDs []int) (map[int][]int, error)
+
+	AcquireLease(ctx context.Context, name, owner string, ttl time.Duration) (bool, error)
+	ReleaseLease(ctx context.Context, name, owner string) error
+}
+
+// FileStoreIn keeps uploaded files, referenced by the url Save returns
+type FileStoreIn interface {
+	Save(ctx context.Context, data []byte, ext string) (string, error)
+	Delete(ctx context.Context, url string) error
+}
 
-	GetAllOnlineUsers(ctx context.Context) ([]OnlineUsersWithLastTimestamp, error)
-	DeleteOnlineStatus(ctx context.Context, userID int) error
+type RateLimitRepoIn interface {
+	Allow(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error)
 }
 
 type MessageServiceIn interface {
 	HandleConn(ctx context.Context, client *Client)
 
-	NewGroupChat(ctx context.Context, name string, authorID int) (int, error)
+	NewGroupChat(ctx context.Context, name string, authorID int, memberIDs []int) (int, error)
 	DeleteGroupChat(ctx context.Context, groupID, userID int) error
+	UpdateGroupChat(ctx context.Context, in *UpdateGroupChatDTO) (*domain.UserChat, error)
+	SetGroupAvatar(ctx context.Context, chatID, userID int, image io.Reader) (*domain.UserChat, error)
+	RemoveGroupAvatar(ctx context.Context, chatID, userID int) (*domain.UserChat, error)
 	PaginateMessages(ctx context.Context, in *PaginateMessagesDTO) ([]domain.Message, *int, bool, error)
 
 	GetUserChats(ctx context.Context, userID int) ([]domain.UserChat, error)
 	NewGroupMember(ctx context.Context, in *GroupMemberDTO) error
 	DeleteGroupMember(ctx context.Context, in *GroupMemberDTO) error
-	GetAllGroupChatMembers(ctx context.Context, chatID int) ([]*domain.ChatMember, error)
+	PaginateGroupChatMembers(ctx context.Context, in *PaginateChatMembersDTO) ([]*domain.ChatMember, *int, bool, error)
 	ChangeGroupMemberRole(ctx context.Context, in *UpdateGroupMemberRoleDTO) error
 }
 
+type UserRepoIn interface {
+	GetUserProfile(ctx context.Context, userID int) (*domain.UserProfile, error)
+	UpdateUserProfile(ctx context.Context, userID int, in *UpdateProfileDTO) (*domain.UserProfile, error)
+	SearchUsers(ctx context.Context, in *SearchUsersDTO) ([]domain.UserSummary, *int, bool, error)
+
+	BlockUser(ctx context.Context, blockerID, blockedID int) error
+	UnblockUser(ctx context.Context, blockerID, blockedID int) error
+	IsBlocked(ctx context.Context, blockerID, blockedID int) (bool, error)
+	IsBlockedInPrivateChat(ctx context.Context, chatID, userID int) (bool, error)
+	GetBlockedUserIDs(ctx context.Context, blockerIDs []int) (map[int][]int, error)
+
+	GetPrivacySettings(ctx context.Context, userID int) (*domain.PrivacySettings, error)
+	GetPrivacySettingsForUsers(ctx context.Context, userIDs []int) (map[int]*domain.PrivacySettings, error)
+	UpdatePrivacySettings(ctx context.Context, userID int, in *UpdatePrivacyDTO) (*domain.PrivacySettings, error)
+	AreContacts(ctx context.Context, userID, otherID int) (bool, error)
+	GetPresenceVisibility(ctx context.Context, viewerID int, userIDs []int) ([]domain.PresenceVisibility, error)
+
+	SetLastSeen(ctx context.Context, lastSeen map[int]time.Time) error
+
+	SetUserStatus(ctx context.Context, userID int, status *domain.UserStatus) error
+	SetDNDSettings(ctx context.Context, userID int, dnd *domain.DNDSettings) error
+	ClearExpiredStatuses(ctx context.Context) ([]int, error)
+
+	GetContacts(ctx context.Context, userID int) ([]domain.UserSummary, error)
+	RemoveContact(ctx context.Context, userID, contactID int) (bool, error)
+	GetContactRequests(ctx context.Context, userID int) ([]domain.ContactRequest, error)
+	CreateContactRequest(ctx context.Context, fromID, toID int) (*domain.ContactRequest, error)
+	AcceptContactRequest(ctx context.Context, fromID, toID int) (*domain.ContactRequest, error)
+	DeleteContactRequest(ctx context.Context, fromID, toID int) (*domain.ContactRequest, error)
+}
+
+type UserServiceIn interface {
+	GetProfile(ctx context.Context, viewerID, userID int) (*domain.UserProfile, error)
+	UpdateProfile(ctx context.Context, userID int, in *UpdateProfileDTO) (*domain.UserProfile, error)
+	SearchUsers(ctx context.Context, in *SearchUsersDTO) ([]domain.UserSummary, *int, bool, error)
+	BlockUser(ctx context.Context, blockerID, blockedID int) error
+	UnblockUser(ctx context.Context, blockerID, blockedID int) error
+	GetPrivacySettings(ctx context.Context, userID int) (*domain.PrivacySettings, error)
+	UpdatePrivacySettings(ctx context.Context, userID int, in *UpdatePrivacyDTO) (*domain.PrivacySettings, error)
+	SetStatus(ctx context.Context, userID int, status *domain.UserStatus) (*domain.UserStatus, error)
+	SetDND(ctx context.Context, userID int, dnd *domain.DNDSettings) (*domain.DNDSettings, error)
+
+	GetContacts(ctx context.Context, userID int) ([]domain.UserSummary, error)
+	RemoveContact(ctx context.Context, userID, contactID int) error
+	GetContactRequests(ctx context.Context, userID int) (incoming, outgoing []domain.ContactRequest, err error)
+	SendContactRequest(ctx context.Context, fromID, toID int) (*domain.ContactRequest, bool, error)
+	AcceptContactRequest(ctx context.Context, userID, fromID int) (*domain.ContactRequest, error)
+	DeclineContactRequest(ctx context.Context, userID, fromID int) error
+	CancelContactRequest(ctx context.Context, userID, toID int) error
+}
+
+type TicketRepoIn interface {
+	SetWSTicket(ctx context.Context, ticket string, session *Session, ttl time.Duration) error
+	ConsumeWSTicket(ctx context.Context, ticket string) (*Session, error)
+}
+
+type TicketServiceIn interface {
+	IssueTicket(ctx context.Context, session *Session) (string, time.Duration, error)
+	RedeemTicket(ctx context.Context, ticket string) (*Session, error)
+}
+
+type SessionRepoIn interface {
+	GetSessionsRevokedAt(ctx context.Context, userID int) (time.Time, error)
+}
+
 type HeartbeatServiceIn interface {
+	Run(ctx context.Context)
 	HandleHeartbeat(ctx context.Context, userID int) error
 	IsUserOnline(ctx context.Context, userID int) bool
+	AreUsersOnline(ctx context.Context, userIDs []int) map[int]bool
+	PublishStatus(ctx context.Context, userID int, status *domain.UserStatus)
 }
@@ -3,12 +3,19 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log/slog"
+	"io"
+	"net"
 	"time"
 
 	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/ReilBleem13/MessangerV2/internal/logger"
+	"github.com/ReilBleem13/MessangerV2/internal/metrics"
+	"github.com/ReilBleem13/MessangerV2/internal/tracing"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -22,38 +29,100 @@ type MessageService struct {
 	heartbeatService HeartbeatServiceIn
 	msgRepo          MessageRepoIn
 	connRepo         ConnectionRepoIn
+	userRepo         UserRepoIn
+	hub              *Hub
+
+	limiter RateLimitRepoIn
+	// budget per frame type, frames without one are not limited
+	frameLimits map[domain.EventType]RateLimit
+
+	// reauth frames are ignored without a secret
+	tokenSecret     string
+	tokenWarnBefore time.Duration
+	sessionRepo     SessionRepoIn
+
+	// group avatar uploads fail without a store
+	avatarStore   FileStoreIn
+	maxAvatarSize int64
 }
 
-func NewMessageService(heartbeatService HeartbeatServiceIn, msgRepo MessageRepoIn, connRepo ConnectionRepoIn) MessageServiceIn {
-	return &MessageService{
+type MessageOption func(ms *MessageService)
+
+// WithFrameRateLimits limits how fast a user may send each frame type, across all of their connections.
+func WithFrameRateLimits(limiter RateLimitRepoIn, limits map[domain.EventType]RateLimit) MessageOption {
+	return func(ms *MessageService) {
+		ms.limiter = limiter
+		ms.frameLimits = limits
+	}
+}
+
+// WithSessionAuth enables reauth frames signed with secret, revocation checks and
+// a token_expiring event warnBefore the access token of a connection expires.
+func WithSessionAuth(secret string, sessionRepo SessionRepoIn, warnBefore time.Duration) MessageOption {
+	return func(ms *MessageService) {
+		ms.tokenSecret = secret
+		ms.sessionRepo = sessionRepo
+		ms.tokenWarnBefore = warnBefore
+	}
+}
+
+// WithAvatarStore enables group avatar uploads of up to maxSize bytes.
+func WithAvatarStore(store FileStoreIn, maxSize int64) MessageOption {
+	return func(ms *MessageService) {
+		ms.avatarStore = store
+		ms.maxAvatarSize = maxSize
+	}
+}
+
+func NewMessageService(heartbeatService HeartbeatServiceIn, msgRepo MessageRepoIn, connRepo ConnectionRepoIn,
+	userRepo UserRepoIn, hub *Hub, opts ...MessageOption) MessageServiceIn {
+	ms := &MessageService{
 		heartbeatService: heartbeatService,
 		msgRepo:          msgRepo,
 		connRepo:         connRepo,
+		userRepo:         userRepo,
+		hub:              hub,
 	}
+
+	for _, opt := range opts {
+		opt(ms)
+	}
+	return ms
 }
 
 func (ms *MessageService) HandleConn(ctx context.Context, client *Client) {
+	ctx = logger.With(ctx, "conn_id", client.connID)
+	client.log = logger.FromContext(ctx)
+
 	client.conn.SetPongHandler(func(string) error {
 		client.conn.SetReadDeadline(time.Now().Add(pongWait))
 
-		slog.Info("Handle heartbeat", "client_id", client.id)
+		logger.FromContext(ctx).Debug("Handle heartbeat", "client_id", client.id)
 
 		if err := ms.heartbeatService.HandleHeartbeat(ctx, client.id); err != nil {
-			slog.Error("Failed t0 handle heartbeat", "user_id", client.id, "error", err)
+			logger.FromContext(ctx).Error("Failed t0 handle heartbeat", "user_id", client.id, "error", err)
 		}
+		client.hub.refresh(ctx, client)
 
 		return nil
 	})
 
+	if !client.hub.register(ctx, client) {
+		client.writeClose(websocket.CloseGoingAway, goingAwayText)
+		client.conn.Close()
+		return
+	}
 	ms.heartbeatService.HandleHeartbeat(ctx, client.id)
 
-	pubSub := ms.connRepo.Subscribe(ctx, client.id)
-	client.outboard = pubSub.Channel()
+	metrics.WSConnectionsOpened.Inc()
+	metrics.WSConnectionsActive.Inc()
 
 	defer func() {
-		client.hub.unregister <- client
+		metrics.WSConnectionsActive.Dec()
+		client.hub.unregister(context.WithoutCancel(ctx), client)
+		ms.removePresenceSubscriptions(context.WithoutCancel(ctx), client)
 		client.conn.Close()
-		pubSub.Close()
+		client.queue.release()
 	}()
 
 	g, ctx := errgroup.WithContext(ctx)
@@ -66,9 +135,16 @@ func (ms *MessageService) HandleConn(ctx context.Context, client *Client) {
 		return ms.write(ctx, client)
 	})
 
+	g.Go(func() error {
+		return ms.watchSession(ctx, client)
+	})
+
 	err := g.Wait()
-	if err != nil && err != context.Canceled {
-		slog.Error("Error during handle Conn", "error", err)
+	reason := closeReason(err)
+	metrics.WSConnectionsClosed.WithLabelValues(reason).Inc()
+
+	if reason == "error" {
+		logger.FromContext(ctx).Error("Error during handle Conn", "error", err)
 	}
 }
 
@@ -87,51 +163,138 @@ func (ms *MessageService) read(ctx context.Context, client *Client) error {
 					websocket.CloseAbnormalClosure,
 					websocket.CloseNoStatusReceived,
 					websocket.CloseNormalClosure) {
-					slog.Error("Websoket close error", "error", err)
+					logger.FromContext(ctx).Error("Websoket close error", "error", err)
 				}
-				return context.Canceled
+				return err
 			}
 
 			var typeCheck struct {
 				Type string `json:"type"`
 			}
 			if err := json.Unmarshal(rawMessage, &typeCheck); err != nil {
-				slog.Error("Failed to unmarshal message type", "error", err)
+				logger.FromContext(ctx).Error("Failed to unmarshal message type", "error", err)
 				continue
 			}
+			metrics.FramesReceived.WithLabelValues(frameTypeLabel(typeCheck.Type)).Inc()
 
-			switch typeCheck.Type {
-			case string(domain.SendMesageType):
-				var msg SendMessageRequest
-				if err := json.Unmarshal(rawMessage, &msg); err != nil {
-					slog.Error("Failed to unmarshal SendMessageRequest", "error", err)
-					continue
-				}
-				ms.mapSendMessageRequest(ctx, client, &msg)
+			frameCtx, span := tracing.Start(ctx, "ws.frame "+frameTypeLabel(typeCheck.Type),
+				trace.WithAttributes(attribute.Int("user.id", client.id)),
+			)
+			ms.handleFrame(frameCtx, client, typeCheck.Type, rawMessage)
+			span.End()
+		}
+	}
+}
 
-			case string(domain.MessageReadType):
-				var msg SendMarkAsReadRequest
-				if err := json.Unmarshal(rawMessage, &msg); err != nil {
-					slog.Error("Failed to unmarshal SendMarkAsReadRequest", "error", err)
-					continue
-				}
-				ms.handleSendMarkAsRead(ctx, client, &msg)
+func (ms *MessageService) handleFrame(ctx context.Context, client *Client, frameType string, rawMessage json.RawMessage) {
+	if !ms.allowFrame(ctx, client, frameType) {
+		return
+	}
 
-			case string(domain.MessageDeliveredType):
-				var msg SendMarkAsDeliveredRequest
-				if err := json.Unmarshal(rawMessage, &msg); err != nil {
-					slog.Error("Failed to unmarshal SendMarkAsDelivered", "error", err)
-					continue
-				}
-				ms.handleSendMarkAsDelivered(ctx, client, &msg)
+	switch frameType {
+	case string(domain.SendMesageType):
+		var msg SendMessageRequest
+		if err := json.Unmarshal(rawMessage, &msg); err != nil {
+			logger.FromContext(ctx).Error("Failed to unmarshal SendMessageRequest", "error", err)
+			return
+		}
+		ms.mapSendMessageRequest(ctx, client, &msg)
 
-			default:
-				slog.Warn("Unknown message type", "type", typeCheck.Type)
-			}
+	case string(domain.MessageReadType):
+		var msg SendMarkAsReadRequest
+		if err := json.Unmarshal(rawMessage, &msg); err != nil {
+			logger.FromContext(ctx).Error("Failed to unmarshal SendMarkAsReadRequest", "error", err)
+			return
+		}
+		ms.handleSendMarkAsRead(ctx, client, &msg)
+
+	case string(domain.MessageDeliveredType):
+		var msg SendMarkAsDeliveredRequest
+		if err := json.Unmarshal(rawMessage, &msg); err != nil {
+			logger.FromContext(ctx).Error("Failed to unmarshal SendMarkAsDelivered", "error", err)
+			return
+		}
+		ms.handleSendMarkAsDelivered(ctx, client, &msg)
+
+	case string(domain.PresenceSubscribeType):
+		var msg PresenceSubscriptionRequest
+		if err := json.Unmarshal(rawMessage, &msg); err != nil {
+			logger.FromContext(ctx).Error("Failed to unmarshal PresenceSubscriptionRequest", "error", err)
+			return
+		}
+		ms.handlePresenceSubscribe(ctx, client, &msg)
+
+	case string(domain.PresenceUnsubscribeType):
+		var msg PresenceSubscriptionRequest
+		if err := json.Unmarshal(rawMessage, &msg); err != nil {
+			logger.FromContext(ctx).Error("Failed to unmarshal PresenceSubscriptionRequest", "error", err)
+			return
 		}
+		ms.handlePresenceUnsubscribe(ctx, client, &msg)
+
+	case string(domain.ReauthType):
+		var msg ReauthRequest
+		if err := json.Unmarshal(rawMessage, &msg); err != nil {
+			logger.FromContext(ctx).Error("Failed to unmarshal ReauthRequest", "error", err)
+			return
+		}
+		ms.handleReauth(ctx, client, &msg)
+
+	default:
+		logger.FromContext(ctx).Warn("Unknown message type", "type", frameType)
 	}
 }
 
+// allowFrame takes a token from the user's budget for frameType and tells the client
+// when to retry if there was none. The frame is let through if Redis is unavailable.
+func (ms *MessageService) allowFrame(ctx context.Context, client *Client, frameType string) bool {
+	if ms.limiter == nil {
+		return true
+	}
+
+	limit, ok := ms.frameLimits[domain.EventType(frameType)]
+	if !ok {
+		return true
+	}
+
+	allowed, retryAfter, err := ms.limiter.Allow(ctx, fmt.Sprintf("ws:%s:%d", frameType, client.id), limit)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to check frame rate limit", "type", frameType, "error", err)
+		return true
+	}
+	if allowed {
+		return true
+	}
+
+	metrics.RateLimited.WithLabelValues(frameType).Inc()
+	ms.sendError(ctx, client, domain.ErrTooManyRequests, frameType, retryAfter)
+	return false
+}
+
+// sendError tells the client a frame of frameType was rejected.
+func (ms *MessageService) sendError(ctx context.Context, client *Client, appErr *domain.AppError,
+	frameType string, retryAfter time.Duration) {
+	ms.sendErrorEvent(ctx, client, &ErrorEvent{
+		Code:         appErr.Code,
+		Message:      appErr.Message,
+		FrameType:    frameType,
+		RetryAfterMs: retryAfter.Milliseconds(),
+	})
+}
+
+func (ms *MessageService) sendErrorEvent(ctx context.Context, client *Client, errorEvent *ErrorEvent) {
+	errorEventByte, err := json.Marshal(errorEvent)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to marshal data", "error", err)
+		return
+	}
+
+	client.enqueue(&ProduceMessage{
+		Type: domain.ErrorType,
+		Data: errorEventByte,
+	})
+}
+
 func (ms *MessageService) mapSendMessageRequest(ctx context.Context, client *Client, msgToSend *SendMessageRequest) {
 	switch msgToSend.Type {
 	case domain.SendMesageType:
@@ -143,8 +306,42 @@ func (ms *MessageService) mapSendMessageRequest(ctx context.Context, client *Cli
 	}
 }
 
+// rejectMessage tells the sender why the recipient of a private message won't get it.
+func (ms *MessageService) rejectMessage(ctx context.Context, client *Client, msgToSend *SendMessageRequest, appErr *domain.AppError) {
+	ms.sendErrorEvent(ctx, client, &ErrorEvent{
+		Code:          appErr.Code,
+		Message:       appErr.Message,
+		FrameType:     string(msgToSend.Type),
+		TempMessageID: msgToSend.TempMessageID,
+	})
+}
+
+// canStartPrivateChat checks the recipient's privacy settings, an existing chat may always be continued.
+func (ms *MessageService) canStartPrivateChat(ctx context.Context, senderID, recipientID int) (bool, error) {
+	settings, err := ms.userRepo.GetPrivacySettings(ctx, recipientID)
+	if err != nil {
+		return false, err
+	}
+	if settings.PrivateChats == domain.PrivacyEveryone {
+		return true, nil
+	}
+
+	isContact := false
+	if settings.PrivateChats == domain.PrivacyContacts {
+		isContact, err = ms.userRepo.AreContacts(ctx, recipientID, senderID)
+		if err != nil {
+			return false, err
+		}
+	}
+	if settings.PrivateChats.Allows(isContact) {
+		return true, nil
+	}
+
+	return ms.msgRepo.HasPrivateChat(ctx, senderID, recipientID)
+}
+
 func (ms *MessageService) handleSendMessage(ctx context.Context, client *Client, msgToSend *SendMessageRequest) {
-	slog.Info("Starting to handle 'SEND MESSAGE'", "client_id", client.id)
+	logger.FromContext(ctx).Debug("Starting to handle 'SEND MESSAGE'", "client_id", client.id)
 
 	var (
 		chatID    int
@@ -155,16 +352,36 @@ func (ms *MessageService) handleSendMessage(ctx context.Context, client *Client,
 	now := time.Now()
 
 	if msgToSend.TempChatID != nil && msgToSend.ToUserID != nil {
+		blocked, err := ms.userRepo.IsBlocked(ctx, *msgToSend.ToUserID, client.id)
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to check block", "error", err)
+			return
+		}
+		if blocked {
+			ms.rejectMessage(ctx, client, msgToSend, domain.ErrBlocked)
+			return
+		}
+
+		allowed, err := ms.canStartPrivateChat(ctx, client.id, *msgToSend.ToUserID)
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to check private chat privacy", "error", err)
+			return
+		}
+		if !allowed {
+			ms.rejectMessage(ctx, client, msgToSend, domain.ErrPrivateChatRestricted)
+			return
+		}
+
 		chatID, isNewChat, err = ms.msgRepo.GetOrCreatePrivateChat(ctx, client.id, *msgToSend.ToUserID)
 		if err != nil {
-			slog.Error("Failed to get or create private chat",
+			logger.FromContext(ctx).Error("Failed to get or create private chat",
 				"error", err,
 				"client_id", client.id,
 				"to_user_id", *msgToSend.ToUserID,
 			)
 			return
 		}
-		slog.Info("Completed 'GetOrCreatePrivateChat'", "chat_id", chatID, "is_new_chat", isNewChat)
+		logger.FromContext(ctx).Debug("Completed 'GetOrCreatePrivateChat'", "chat_id", chatID, "is_new_chat", isNewChat)
 
 		// send new chat event to recipient
 		newChatEvent := NewChatEvent{
@@ -176,7 +393,7 @@ func (ms *MessageService) handleSendMessage(ctx context.Context, client *Client,
 
 		newChatEventByte, err := json.Marshal(&newChatEvent)
 		if err != nil {
-			slog.Error("Failed to marshal new chat event", "error", err)
+			logger.FromContext(ctx).Error("Failed to marshal new chat event", "error", err)
 			return
 		}
 
@@ -185,10 +402,21 @@ func (ms *MessageService) handleSendMessage(ctx context.Context, client *Client,
 			Data: newChatEventByte,
 		})
 
-		slog.Info("produced new chat event to user", "user_id", *msgToSend.ToUserID)
+		logger.FromContext(ctx).Debug("produced new chat event to user", "user_id", *msgToSend.ToUserID)
 	} else {
 		chatID = *msgToSend.ChatID
+
+		blocked, err := ms.userRepo.IsBlockedInPrivateChat(ctx, chatID, client.id)
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to check block", "error", err)
+			return
+		}
+		if blocked {
+			ms.rejectMessage(ctx, client, msgToSend, domain.ErrBlocked)
+			return
+		}
 	}
+	ctx = logger.With(ctx, "chat_id", chatID)
 
 	messageID, err := ms.msgRepo.NewMessage(ctx, &domain.Message{
 		MessageType: domain.NewMessageType,
@@ -197,7 +425,7 @@ func (ms *MessageService) handleSendMessage(ctx context.Context, client *Client,
 		Content:     msgToSend.Content,
 	})
 	if err != nil {
-		slog.Error("Failed to save message to DB",
+		logger.FromContext(ctx).Error("Failed to save message to DB",
 			"error", err,
 			"client_id", client.id,
 		)
@@ -216,7 +444,7 @@ func (ms *MessageService) handleSendMessage(ctx context.Context, client *Client,
 
 	msgConfirmedEventByte, err := json.Marshal(&msgConfirmedEvent)
 	if err != nil {
-		slog.Error("Failed to marshal msg confimed event", "error", err)
+		logger.FromContext(ctx).Error("Failed to marshal msg confimed event", "error", err)
 		return
 	}
 
@@ -225,7 +453,11 @@ func (ms *MessageService) handleSendMessage(ctx context.Context, client *Client,
 		Data: msgConfirmedEventByte,
 	})
 
-	slog.Info("Produced confirmed event to client")
+	if !msgToSend.ClientSendAt.IsZero() {
+		metrics.MessageSendLatency.Observe(time.Since(msgToSend.ClientSendAt).Seconds())
+	}
+
+	logger.FromContext(ctx).Debug("Produced confirmed event to client")
 
 	// send new message event to recepient
 	newMessageEvent := NewMessageEvent{
@@ -238,39 +470,34 @@ func (ms *MessageService) handleSendMessage(ctx context.Context, client *Client,
 
 	newMessageEventByte, err := json.Marshal(&newMessageEvent)
 	if err != nil {
-		slog.Error("Failed to marshal new message event", "error", err)
+		logger.FromContext(ctx).Error("Failed to marshal new message event", "error", err)
 		return
 	}
 
-	chatMembers, err := ms.msgRepo.GetAllChatMembers(ctx, chatID)
+	memberIDs, err := ms.msgRepo.GetChatMemberIDs(ctx, chatID)
 	if err != nil {
-		slog.Error("Failed to get all chat members", "error", err)
+		logger.FromContext(ctx).Error("Failed to get all chat members", "error", err)
 		return
 	}
 
-	slog.Info("Completed GetAllChatMembers", "chatMembers", chatMembers)
-
-	for _, member := range chatMembers {
-		if member.ID != client.id {
-			ms.handleProduce(ctx, member.ID, &ProduceMessage{
-				Type: domain.NewMessageType,
-				Data: newMessageEventByte,
-			})
+	logger.FromContext(ctx).Debug("Completed GetChatMemberIDs", "member_ids", memberIDs)
 
-			slog.Info("Produced message event to member", "member-id", member.ID)
-		}
-	}
-	slog.Info("Message successfully provided", "message_id", messageID, "client_id", client)
+	ms.hub.broadcast(ctx, excludeUser(memberIDs, client.id), &ProduceMessage{
+		Type: domain.NewMessageType,
+		Data: newMessageEventByte,
+	})
+	logger.FromContext(ctx).Debug("Message successfully provided", "message_id", messageID)
 }
 
 func (ms *MessageService) handleEditMessage(ctx context.Context, client *Client, msgToSend *SendMessageRequest) {
 	if msgToSend.MessageID == nil || msgToSend.ChatID == nil {
-		slog.Error("Failed to handle edit message, messageID/chatID is nil")
+		logger.FromContext(ctx).Error("Failed to handle edit message, messageID/chatID is nil")
 		return
 	}
+	ctx = logger.With(ctx, "chat_id", *msgToSend.ChatID)
 
 	if err := ms.msgRepo.EditMessage(ctx, *msgToSend.MessageID, msgToSend.Content); err != nil {
-		slog.Error("Failed tp edit message", "error", err)
+		logger.FromContext(ctx).Error("Failed tp edit message", "error", err)
 		return
 	}
 
@@ -287,7 +514,7 @@ func (ms *MessageService) handleEditMessage(ctx context.Context, client *Client,
 
 	msgConfirmedEventByte, err := json.Marshal(&msgConfirmedEvent)
 	if err != nil {
-		slog.Error("Failed to marshal msg confimed event", "error", err)
+		logger.FromContext(ctx).Error("Failed to marshal msg confimed event", "error", err)
 		return
 	}
 
@@ -306,48 +533,45 @@ func (ms *MessageService) handleEditMessage(ctx context.Context, client *Client,
 
 	editMessageEventByte, err := json.Marshal(&editMessageEvent)
 	if err != nil {
-		slog.Error("Failed to marshal edit message event", "error", err)
+		logger.FromContext(ctx).Error("Failed to marshal edit message event", "error", err)
 		return
 	}
 
-	chatMembers, err := ms.msgRepo.GetAllChatMembers(ctx, *msgToSend.ChatID)
+	memberIDs, err := ms.msgRepo.GetChatMemberIDs(ctx, *msgToSend.ChatID)
 	if err != nil {
-		slog.Error("Failed to get all chat members", "error", err)
+		logger.FromContext(ctx).Error("Failed to get all chat members", "error", err)
 		return
 	}
 
-	for _, member := range chatMembers {
-		if member.ID != client.id {
-			ms.handleProduce(ctx, member.ID, &ProduceMessage{
-				Type: domain.EditMessageType,
-				Data: editMessageEventByte,
-			})
-		}
-	}
-	slog.Debug("Message successfully provided", "message_id", msgToSend.MessageID, "client_id", client)
+	ms.hub.broadcast(ctx, excludeUser(memberIDs, client.id), &ProduceMessage{
+		Type: domain.EditMessageType,
+		Data: editMessageEventByte,
+	})
+	logger.FromContext(ctx).Debug("Message successfully provided", "message_id", msgToSend.MessageID)
 }
 
 func (ms *MessageService) handleDeleteMessage(ctx context.Context, client *Client, msgToSend *SendMessageRequest) {
 	if msgToSend.MessageID == nil || msgToSend.ChatID == nil {
-		slog.Error("Failed to handle delete message, messageID/chatID is nil")
+		logger.FromContext(ctx).Error("Failed to handle delete message, messageID/chatID is nil")
 		return
 	}
+	ctx = logger.With(ctx, "chat_id", *msgToSend.ChatID)
 
 	authorID, err := ms.msgRepo.GetMessageAuthorID(ctx, *msgToSend.MessageID)
 	if err != nil {
-		slog.Error("Failed to get message author id", "error", err)
+		logger.FromContext(ctx).Error("Failed to get message author id", "error", err)
 		return
 	}
 
 	if authorID != client.id {
 		role, err := ms.msgRepo.GetGroupChatMemberRole(ctx, client.id, *msgToSend.ChatID)
 		if err != nil {
-			slog.Error("Failed to get role", "error", err)
+			logger.FromContext(ctx).Error("Failed to get role", "error", err)
 			return
 		}
 
 		if role != domain.AdminRole {
-			slog.Error("Failed to delete message, not enough right")
+			logger.FromContext(ctx).Error("Failed to delete message, not enough right")
 			return
 		}
 	}
@@ -365,7 +589,7 @@ func (ms *MessageService) handleDeleteMessage(ctx context.Context, client *Clien
 
 	msgConfirmedEventByte, err := json.Marshal(&msgConfirmedEvent)
 	if err != nil {
-		slog.Error("Failed to marshal msg confimed event", "error", err)
+		logger.FromContext(ctx).Error("Failed to marshal msg confimed event", "error", err)
 		return
 	}
 
@@ -382,30 +606,28 @@ func (ms *MessageService) handleDeleteMessage(ctx context.Context, client *Clien
 
 	deleteMessageEventByte, err := json.Marshal(&deleteMessageEvent)
 	if err != nil {
-		slog.Error("Failed to marshal delete message event", "error", err)
+		logger.FromContext(ctx).Error("Failed to marshal delete message event", "error", err)
 		return
 	}
 
-	chatMembers, err := ms.msgRepo.GetAllChatMembers(ctx, *msgToSend.ChatID)
+	memberIDs, err := ms.msgRepo.GetChatMemberIDs(ctx, *msgToSend.ChatID)
 	if err != nil {
-		slog.Error("Failed to get all chat members", "error", err)
+		logger.FromContext(ctx).Error("Failed to get all chat members", "error", err)
 		return
 	}
 
-	for _, member := range chatMembers {
-		if member.ID != client.id {
-			ms.handleProduce(ctx, member.ID, &ProduceMessage{
-				Type: domain.DeleteMessageType,
-				Data: deleteMessageEventByte,
-			})
-		}
-	}
-	slog.Debug("Message successfully provided", "message_id", msgToSend.MessageID, "client_id", client)
+	ms.hub.broadcast(ctx, excludeUser(memberIDs, client.id), &ProduceMessage{
+		Type: domain.DeleteMessageType,
+		Data: deleteMessageEventByte,
+	})
+	logger.FromContext(ctx).Debug("Message successfully provided", "message_id", msgToSend.MessageID)
 }
 
 func (ms *MessageService) handleSendMarkAsDelivered(ctx context.Context, client *Client, msgToSend *SendMarkAsDeliveredRequest) {
+	ctx = logger.With(ctx, "chat_id", msgToSend.ChatID)
+
 	if err := ms.msgRepo.SetDeliveredAtStatus(ctx, msgToSend.MessageID, client.id); err != nil {
-		slog.Error("Failed to set delivered at status",
+		logger.FromContext(ctx).Error("Failed to set delivered at status",
 			"message_id", msgToSend.MessageID,
 			"client_id", client.id,
 			"error", err,
@@ -420,29 +642,29 @@ func (ms *MessageService) handleSendMarkAsDelivered(ctx context.Context, client
 
 	deliveredEventByte, err := json.Marshal(&deliveredEvent)
 	if err != nil {
-		slog.Error("Failed to marshal new message event", "error", err)
+		logger.FromContext(ctx).Error("Failed to marshal new message event", "error", err)
 		return
 	}
 
-	chatMembers, err := ms.msgRepo.GetAllChatMembers(ctx, msgToSend.ChatID)
+	memberIDs, err := ms.msgRepo.GetChatMemberIDs(ctx, msgToSend.ChatID)
 	if err != nil {
-		slog.Error("Failed to get all chat members", "error", err)
+		logger.FromContext(ctx).Error("Failed to get all chat members", "error", err)
 		return
 	}
 
 	// It also sends a message to the client so that he receives a confirmation of his delivery
-	for _, member := range chatMembers {
-		ms.handleProduce(ctx, member.ID, &ProduceMessage{
-			Type: domain.MessageDeliveredType,
-			Data: deliveredEventByte,
-		})
-	}
+	ms.hub.broadcast(ctx, memberIDs, &ProduceMessage{
+		Type: domain.MessageDeliveredType,
+		Data: deliveredEventByte,
+	})
 }
 
 func (ms *MessageService) handleSendMarkAsRead(ctx context.Context, client *Client, msgToSend *SendMarkAsReadRequest) {
+	ctx = logger.With(ctx, "chat_id", msgToSend.ChatID)
+
 	err := ms.msgRepo.SetReadAtStatus(ctx, msgToSend.UpToID, msgToSend.ChatID, client.id)
 	if err != nil {
-		slog.Error("Failed to set read at status",
+		logger.FromContext(ctx).Error("Failed to set read at status",
 			"chat_id", msgToSend.ChatID,
 			"client_at", client.id,
 			"error", err,
@@ -459,36 +681,27 @@ func (ms *MessageService) handleSendMarkAsRead(ctx context.Context, client *Clie
 
 	readMessageEventByte, err := json.Marshal(&readMessageEvent)
 	if err != nil {
-		slog.Error("Failed to marshal read message event", "error", err)
+		logger.FromContext(ctx).Error("Failed to marshal read message event", "error", err)
 		return
 	}
 
-	chatMembers, err := ms.msgRepo.GetAllChatMembers(ctx, msgToSend.ChatID)
+	memberIDs, err := ms.msgRepo.GetChatMemberIDs(ctx, msgToSend.ChatID)
 	if err != nil {
-		slog.Error("Failed to get all chat members", "error", err)
+		logger.FromContext(ctx).Error("Failed to get all chat members", "error", err)
 		return
 	}
 
 	// It also sends a message to the client so that he receives a confirmation of his delivery
-	for _, member := range chatMembers {
-		ms.handleProduce(ctx, member.ID, &ProduceMessage{
-			Type: domain.MessageReadType,
-			Data: readMessageEventByte,
-		})
-	}
+	ms.hub.broadcast(ctx, memberIDs, &ProduceMessage{
+		Type: domain.MessageReadType,
+		Data: readMessageEventByte,
+	})
 }
 
 func (ms *MessageService) handleProduce(ctx context.Context, toUserID int, msgToSend *ProduceMessage) {
-	if !ms.heartbeatService.IsUserOnline(ctx, toUserID) {
-		slog.Info("User is not online", "user_id", toUserID)
-		return
-	}
-
-	channel := fmt.Sprintf("message:%d", toUserID)
-
-	err := ms.connRepo.Produce(ctx, channel, msgToSend)
-	if err != nil {
-		slog.Error("Failed to produce message", "to_user_id", toUserID, "error", err)
+	if err := ms.hub.Publish(ctx, []int{toUserID}, msgToSend); err != nil {
+		metrics.ProduceFailures.Inc()
+		logger.FromContext(ctx).Error("Failed to produce message", "to_user_id", toUserID, "error", err)
 	}
 }
 
@@ -505,30 +718,122 @@ func (ms *MessageService) write(ctx context.Context, client *Client) error {
 		case <-ticker.C:
 			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				slog.Error("Failed to write ping message", "error", err)
+				logger.FromContext(ctx).Error("Failed to write ping message", "error", err)
 				return err
 			}
-		case msg, ok := <-client.outboard:
-			if !ok {
-				return nil
+		case <-client.queue.notify:
+			if err := ms.flush(ctx, client); err != nil {
+				return err
 			}
-
-			var outboardMsg ProduceMessage
-			if err := json.Unmarshal([]byte(msg.Payload), &outboardMsg); err != nil {
-				slog.Error("Failed to unmarshal outboard message", "error", err)
+		case <-client.resync:
+			client.writeClose(CloseResyncRequired, "resync required")
+			return errResyncRequired
+		case <-client.sessionEnd:
+			if err := ms.flush(ctx, client); err != nil {
 				return err
 			}
 
-			slog.Info("Accept event",
-				"clint_id", client.id,
-				"event", outboardMsg.Type,
-			)
-
-			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := client.conn.WriteJSON(&outboardMsg); err != nil {
-				slog.Error("Failed to writeJSON", "error", err)
+			if client.sessionErr == errSessionRevoked {
+				client.writeClose(CloseSessionRevoked, "session revoked")
+			} else {
+				client.writeClose(CloseTokenExpired, "token expired")
+			}
+			return client.sessionErr
+		case <-client.shutdown:
+			if err := ms.flush(ctx, client); err != nil {
 				return err
 			}
+
+			client.writeClose(websocket.CloseGoingAway, goingAwayText)
+
+			// give the client a moment to answer the close frame instead of waiting for pong timeout
+			client.conn.SetReadDeadline(time.Now().Add(writeWait))
+			return errGoingAway
+		}
+	}
+}
+
+func (ms *MessageService) flush(ctx context.Context, client *Client) error {
+	for _, msg := range client.queue.drain() {
+		if err := ms.writeEvent(ctx, client, msg); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// writeEvent writes a single event, its span is linked to the span that produced the event.
+func (ms *MessageService) writeEvent(ctx context.Context, client *Client, msg *ProduceMessage) error {
+	opts := []trace.SpanStartOption{
+		trace.WithAttributes(attribute.Int("user.id", client.id)),
+	}
+
+	producer := trace.SpanContextFromContext(tracing.Extract(ctx, msg.TraceContext))
+	if producer.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: producer}))
+	}
+
+	_, span := tracing.Start(ctx, "ws.write "+string(msg.Type), opts...)
+	defer span.End()
+
+	logger.FromContext(ctx).Debug("Accept event",
+		"clint_id", client.id,
+		"event", msg.Type,
+	)
+
+	out := *msg
+	out.TraceContext = nil
+
+	client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := client.conn.WriteJSON(&out); err != nil {
+		span.RecordError(err)
+		logger.FromContext(ctx).Error("Failed to writeJSON", "error", err)
+		return err
+	}
+	return nil
+}
+
+func closeReason(err error) string {
+	switch err {
+	case nil, context.Canceled:
+		return "client_closed"
+	case errResyncRequired:
+		return "resync_required"
+	case errGoingAway:
+		return "going_away"
+	case errTokenExpired:
+		return "token_expired"
+	case errSessionRevoked:
+		return "session_revoked"
+	}
+
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+		return "client_closed"
+	}
+	// includes 1006, the connection dropped without a close frame
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return "abnormal_close"
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		// no pong within pongWait
+		return "timeout"
+	}
+	if netErr != nil || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return "network_error"
+	}
+	return "error"
+}
+
+// keeps the label set bounded, the type comes from the client
+func frameTypeLabel(frameType string) string {
+	switch domain.EventType(frameType) {
+	case domain.SendMesageType, domain.MessageReadType, domain.MessageDeliveredType, domain.ReauthType,
+		domain.PresenceSubscribeType, domain.PresenceUnsubscribeType:
+		return frameType
+	default:
+		return "unknown"
+	}
 }
@@ -0,0 +1,43 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCloseReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil", nil, "client_closed"},
+		{"canceled", context.Canceled, "client_closed"},
+		{"normal close", &websocket.CloseError{Code: websocket.CloseNormalClosure}, "client_closed"},
+		{"going away", &websocket.CloseError{Code: websocket.CloseGoingAway}, "client_closed"},
+		{"abnormal close", &websocket.CloseError{Code: websocket.CloseAbnormalClosure}, "abnormal_close"},
+		{"protocol error", &websocket.CloseError{Code: websocket.CloseProtocolError}, "abnormal_close"},
+		{"read timeout", &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, "timeout"},
+		{"connection reset", &net.OpError{Op: "read", Net: "tcp", Err: fmt.Errorf("connection reset by peer")}, "network_error"},
+		{"eof", io.ErrUnexpectedEOF, "network_error"},
+		{"resync", errResyncRequired, "resync_required"},
+		{"server going away", errGoingAway, "going_away"},
+		{"token expired", errTokenExpired, "token_expired"},
+		{"session revoked", errSessionRevoked, "session_revoked"},
+		{"other", fmt.Errorf("boom"), "error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := closeReason(tt.err); got != tt.want {
+				t.Errorf("closeReason(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
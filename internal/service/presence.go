@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/ReilBleem13/MessangerV2/internal/logger"
+)
+
+// subscriptions one connection may hold, e.g. the members of the open chat
+const maxPresenceSubscriptions = 200
+
+// handlePresenceSubscribe subscribes the connection to presence changes of the users
+// and answers with their current presence.
+func (ms *MessageService) handlePresenceSubscribe(ctx context.Context, client *Client, in *PresenceSubscriptionRequest) {
+	userIDs := slices.DeleteFunc(slices.Clone(in.UserIDs), func(id int) bool {
+		return id == client.id
+	})
+	if len(userIDs) == 0 {
+		return
+	}
+	if len(userIDs) > maxPresenceSubscriptions {
+		ms.sendError(ctx, client, domain.ErrInvalidRequest.WithMessage("Too many presence subscriptions"), string(in.Type), 0)
+		return
+	}
+
+	visibility, err := ms.userRepo.GetPresenceVisibility(ctx, client.id, userIDs)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get presence visibility", "error", err)
+		return
+	}
+
+	// users who blocked the subscriber are left out silently, as are unknown ids
+	allowed := make([]int, 0, len(visibility))
+	for _, v := range visibility {
+		if !v.BlockedViewer {
+			allowed = append(allowed, v.UserID)
+		}
+	}
+
+	added, ok := client.addPresenceTargets(allowed, maxPresenceSubscriptions)
+	if !ok {
+		ms.sendError(ctx, client, domain.ErrInvalidRequest.WithMessage("Too many presence subscriptions"), string(in.Type), 0)
+		return
+	}
+
+	if err := ms.connRepo.AddPresenceSubscriptions(ctx, client.id, client.connID, added); err != nil {
+		client.removePresenceTargets(added)
+		logger.FromContext(ctx).Error("Failed to add presence subscriptions", "error", err)
+		return
+	}
+
+	ms.sendPresenceSnapshot(ctx, client, visibility)
+}
+
+func (ms *MessageService) handlePresenceUnsubscribe(ctx context.Context, client *Client, in *PresenceSubscriptionRequest) {
+	removed := client.removePresenceTargets(in.UserIDs)
+
+	if err := ms.connRepo.RemovePresenceSubscriptions(ctx, client.id, client.connID, removed); err != nil {
+		logger.FromContext(ctx).Error("Failed to remove presence subscriptions", "error", err)
+	}
+}
+
+// removePresenceSubscriptions drops everything the connection subscribed to, called when it closes.
+func (ms *MessageService) removePresenceSubscriptions(ctx context.Context, client *Client) {
+	targets := client.allPresenceTargets()
+
+	if err := ms.connRepo.RemovePresenceSubscriptions(ctx, client.id, client.connID, targets); err != nil {
+		logger.FromContext(ctx).Error("Failed to remove presence subscriptions", "error", err)
+	}
+}
+
+func (ms *MessageService) sendPresenceSnapshot(ctx context.Context, client *Client, visibility []domain.PresenceVisibility) {
+	userIDs := make([]int, 0, len(visibility))
+	for _, v := range visibility {
+		if !v.BlockedViewer {
+			userIDs = append(userIDs, v.UserID)
+		}
+	}
+	online := ms.heartbeatService.AreUsersOnline(ctx, userIDs)
+
+	now := time.Now()
+	snapshot := PresenceSnapshotEvent{
+		Users: make([]PresenceEvent, 0, len(userIDs)),
+	}
+	for _, v := range visibility {
+		if v.BlockedViewer {
+			continue
+		}
+
+		event := PresenceEvent{
+			UserID:   v.UserID,
+			Presence: online[v.UserID] && v.OnlinePrivacy.Allows(v.IsContact),
+		}
+		if !event.Presence && v.LastSeenPrivacy.Allows(v.IsContact) {
+			event.LastSeenAt = v.LastSeenAt
+		}
+		if v.OnlinePrivacy.Allows(v.IsContact) && v.UserStatus.IsSet(now) {
+			event.Status = &v.UserStatus
+		}
+		snapshot.Users = append(snapshot.Users, event)
+	}
+
+	snapshotEventByte, err := json.Marshal(&snapshot)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to marshal data", "error", err)
+		return
+	}
+
+	client.enqueue(&ProduceMessage{
+		Type: domain.PresenceSnapshotType,
+		Data: snapshotEventByte,
+	})
+}
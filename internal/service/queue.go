@@ -0,0 +1,97 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/ReilBleem13/MessangerV2/internal/metrics"
+)
+
+type QueuePolicy string
+
+const (
+	// drop ephemeral events first and disconnect only when the queue is full of durable ones
+	DropEphemeralPolicy QueuePolicy = "drop_ephemeral"
+	// disconnect as soon as the queue is full
+	DisconnectPolicy QueuePolicy = "disconnect"
+)
+
+const defaultSendQueueSize = 256
+
+// sendQueue is a bounded outbound queue of a single connection. Producers never block on it,
+// a slow consumer either loses ephemeral events or gets disconnected and has to resync.
+type sendQueue struct {
+	mu       sync.Mutex
+	items    []*ProduceMessage
+	capacity int
+	policy   QueuePolicy
+	// signals the writer that items are available
+	notify chan struct{}
+}
+
+func newSendQueue(capacity int, policy QueuePolicy) *sendQueue {
+	return &sendQueue{
+		items:    make([]*ProduceMessage, 0, capacity),
+		capacity: capacity,
+		policy:   policy,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// push returns false if msg could not be queued without losing a durable event.
+func (q *sendQueue) push(msg *ProduceMessage) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) >= q.capacity {
+		if q.policy == DisconnectPolicy {
+			return false
+		}
+
+		if msg.Type.IsEphemeral() {
+			metrics.SendQueueDropped.Inc()
+			return true
+		}
+
+		if !q.evictEphemeral() {
+			return false
+		}
+	}
+
+	q.items = append(q.items, msg)
+	metrics.SendQueueDepth.Inc()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// evictEphemeral removes the oldest ephemeral event, must be called with mu held.
+func (q *sendQueue) evictEphemeral() bool {
+	for i, item := range q.items {
+		if item.Type.IsEphemeral() {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			metrics.SendQueueDepth.Dec()
+			metrics.SendQueueDropped.Inc()
+			return true
+		}
+	}
+	return false
+}
+
+// drain takes everything queued so far.
+func (q *sendQueue) drain() []*ProduceMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	items := q.items
+	q.items = make([]*ProduceMessage, 0, q.capacity)
+	metrics.SendQueueDepth.Sub(float64(len(items)))
+	return items
+}
+
+// release drops whatever is left after the connection is gone.
+func (q *sendQueue) release() {
+	q.drain()
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"log/slog"
+	"slices"
+	"testing"
+
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
+)
+
+func durable(id string) *ProduceMessage {
+	return &ProduceMessage{Type: domain.NewMessageType, Data: []byte(id)}
+}
+
+func ephemeral(id string) *ProduceMessage {
+	return &ProduceMessage{Type: domain.PresenceChangeType, Data: []byte(id)}
+}
+
+func queued(items []*ProduceMessage) []string {
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = string(item.Data)
+	}
+	return ids
+}
+
+func TestSendQueuePush(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		policy   QueuePolicy
+		prefill  []*ProduceMessage
+		push     *ProduceMessage
+		wantOK   bool
+		want     []string
+	}{
+		{
+			name:     "room left",
+			capacity: 2,
+			policy:   DropEphemeralPolicy,
+			prefill:  []*ProduceMessage{durable("a")},
+			push:     durable("b"),
+			wantOK:   true,
+			want:     []string{"a", "b"},
+		},
+		{
+			name:     "full, ephemeral is dropped",
+			capacity: 2,
+			policy:   DropEphemeralPolicy,
+			prefill:  []*ProduceMessage{durable("a"), durable("b")},
+			push:     ephemeral("c"),
+			wantOK:   true,
+			want:     []string{"a", "b"},
+		},
+		{
+			name:     "full, durable evicts the oldest ephemeral",
+			capacity: 3,
+			policy:   DropEphemeralPolicy,
+			prefill:  []*ProduceMessage{durable("a"), ephemeral("b"), ephemeral("c")},
+			push:     durable("d"),
+			wantOK:   true,
+			want:     []string{"a", "c", "d"},
+		},
+		{
+			name:     "full of durable events",
+			capacity: 2,
+			policy:   DropEphemeralPolicy,
+			prefill:  []*ProduceMessage{durable("a"), durable("b")},
+			push:     durable("c"),
+			wantOK:   false,
+			want:     []string{"a", "b"},
+		},
+		{
+			name:     "disconnect policy, room left",
+			capacity: 2,
+			policy:   DisconnectPolicy,
+			prefill:  []*ProduceMessage{ephemeral("a")},
+			push:     durable("b"),
+			wantOK:   true,
+			want:     []string{"a", "b"},
+		},
+		{
+			name:     "disconnect policy, full of ephemeral events",
+			capacity: 2,
+			policy:   DisconnectPolicy,
+			prefill:  []*ProduceMessage{ephemeral("a"), ephemeral("b")},
+			push:     ephemeral("c"),
+			wantOK:   false,
+			want:     []string{"a", "b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newSendQueue(tt.capacity, tt.policy)
+			for _, msg := range tt.prefill {
+				if !q.push(msg) {
+					t.Fatalf("prefill push of %s failed", msg.Data)
+				}
+			}
+
+			if ok := q.push(tt.push); ok != tt.wantOK {
+				t.Errorf("push() = %v, want %v", ok, tt.wantOK)
+			}
+			if got := queued(q.drain()); !slices.Equal(got, tt.want) {
+				t.Errorf("queued %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendQueueNotify(t *testing.T) {
+	q := newSendQueue(4, DropEphemeralPolicy)
+	q.push(durable("a"))
+	q.push(durable("b"))
+
+	select {
+	case <-q.notify:
+	default:
+		t.Fatal("push didn't notify the writer")
+	}
+	// several pushes collapse into one wakeup
+	select {
+	case <-q.notify:
+		t.Fatal("got a second notification")
+	default:
+	}
+
+	if got := queued(q.drain()); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("drained %v", got)
+	}
+	if got := q.drain(); len(got) != 0 {
+		t.Errorf("second drain returned %d items", len(got))
+	}
+}
+
+func TestClientEnqueueOverflow(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     QueuePolicy
+		push       []*ProduceMessage
+		wantResync bool
+	}{
+		{
+			name:       "ephemeral overflow keeps the connection",
+			policy:     DropEphemeralPolicy,
+			push:       []*ProduceMessage{durable("a"), ephemeral("b"), ephemeral("c")},
+			wantResync: false,
+		},
+		{
+			name:       "durable overflow asks for a resync",
+			policy:     DropEphemeralPolicy,
+			push:       []*ProduceMessage{durable("a"), durable("b"), durable("c")},
+			wantResync: true,
+		},
+		{
+			name:       "disconnect policy asks for a resync on any overflow",
+			policy:     DisconnectPolicy,
+			push:       []*ProduceMessage{ephemeral("a"), ephemeral("b"), ephemeral("c")},
+			wantResync: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{
+				queue:  newSendQueue(2, tt.policy),
+				log:    slog.Default(),
+				resync: make(chan struct{}),
+			}
+			// overflowing more than once must not close resync twice
+			for _, msg := range append(tt.push, tt.push...) {
+				c.enqueue(msg)
+			}
+
+			select {
+			case <-c.resync:
+				if !tt.wantResync {
+					t.Error("client was asked to resync")
+				}
+			default:
+				if tt.wantResync {
+					t.Error("client wasn't asked to resync")
+				}
+			}
+		})
+	}
+}
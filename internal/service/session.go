@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/ReilBleem13/MessangerV2/internal/logger"
+	"github.com/ReilBleem13/MessangerV2/internal/utils"
+)
+
+const (
+	// The access token lapsed without a reauth frame, the client has to reconnect with a fresh one
+	CloseTokenExpired = 4001
+	// Sessions of the user were revoked (logout, password change), the client has to log in again
+	CloseSessionRevoked = 4002
+)
+
+// how often a live session is checked for revocation
+const sessionCheckInterval = 30 * time.Second
+
+var (
+	errTokenExpired   = errors.New("access token expired")
+	errSessionRevoked = errors.New("session revoked")
+)
+
+func SessionFromClaims(claims *utils.AccessClaims) *Session {
+	session := &Session{
+		UserID: claims.UserID,
+	}
+	if claims.IssuedAt != nil {
+		session.IssuedAt = claims.IssuedAt.Time
+	}
+	if claims.ExpiresAt != nil {
+		session.ExpiresAt = claims.ExpiresAt.Time
+	}
+	return session
+}
+
+func (s *Session) expires() bool {
+	return !s.ExpiresAt.IsZero()
+}
+
+// watchSession ends the connection when its token expires or the user's sessions are revoked
+// and warns the client tokenWarnBefore the expiry so it can send a reauth frame.
+func (ms *MessageService) watchSession(ctx context.Context, client *Client) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var warned time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		case <-client.reauthed:
+		}
+
+		session := client.currentSession()
+
+		if ms.isRevoked(ctx, session) {
+			client.endSession(errSessionRevoked)
+			return nil
+		}
+
+		wait := sessionCheckInterval
+		if session.expires() {
+			now := time.Now()
+			if !now.Before(session.ExpiresAt) {
+				client.endSession(errTokenExpired)
+				return nil
+			}
+
+			warnAt := session.ExpiresAt.Add(-ms.tokenWarnBefore)
+			if !warned.Equal(session.ExpiresAt) {
+				if !now.Before(warnAt) {
+					ms.sendSessionEvent(ctx, client, domain.TokenExpiringType, session)
+					warned = session.ExpiresAt
+				} else {
+					wait = min(wait, warnAt.Sub(now))
+				}
+			}
+			wait = min(wait, session.ExpiresAt.Sub(now))
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+func (ms *MessageService) isRevoked(ctx context.Context, session Session) bool {
+	if ms.sessionRepo == nil {
+		return false
+	}
+
+	revokedAt, err := ms.sessionRepo.GetSessionsRevokedAt(ctx, session.UserID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to check session revocation", "error", err)
+		return false
+	}
+	return !revokedAt.IsZero() && !session.IssuedAt.After(revokedAt)
+}
+
+// handleReauth replaces the session of the connection with the one from a fresh access token of the same user.
+func (ms *MessageService) handleReauth(ctx context.Context, client *Client, in *ReauthRequest) {
+	if ms.tokenSecret == "" {
+		return
+	}
+
+	claims, err := utils.ValidateAccessToken(in.Token, ms.tokenSecret)
+	if err != nil || claims.UserID != client.id {
+		ms.sendError(ctx, client, domain.ErrInvalidToken, string(domain.ReauthType), 0)
+		return
+	}
+
+	session := SessionFromClaims(claims)
+	if ms.isRevoked(ctx, *session) {
+		ms.sendError(ctx, client, domain.ErrInvalidToken, string(domain.ReauthType), 0)
+		return
+	}
+
+	client.setSession(session)
+	ms.sendSessionEvent(ctx, client, domain.ReauthenticatedType, *session)
+}
+
+func (ms *MessageService) sendSessionEvent(ctx context.Context, client *Client, eventType domain.EventType, session Session) {
+	sessionEventByte, err := json.Marshal(&SessionEvent{
+		ExpiresAt: session.ExpiresAt,
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to marshal data", "error", err)
+		return
+	}
+
+	client.enqueue(&ProduceMessage{
+		Type: eventType,
+		Data: sessionEventByte,
+	})
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/ReilBleem13/MessangerV2/internal/logger"
+)
+
+const (
+	// users.status_text is VARCHAR(100), users.status_emoji VARCHAR(32)
+	maxStatusTextLength  = 100
+	maxStatusEmojiLength = 32
+)
+
+// SetStatus replaces the user's status, an empty status clears it.
+func (us *UserService) SetStatus(ctx context.Context, userID int, status *domain.UserStatus) (*domain.UserStatus, error) {
+	status.Text = strings.TrimSpace(status.Text)
+	status.Emoji = strings.TrimSpace(status.Emoji)
+
+	switch {
+	case utf8.RuneCountInString(status.Text) > maxStatusTextLength:
+		return nil, domain.ErrInvalidRequest.WithMessage("Status text is too long")
+	case utf8.RuneCountInString(status.Emoji) > maxStatusEmojiLength:
+		return nil, domain.ErrInvalidRequest.WithMessage("Status emoji is too long")
+	case status.ExpiresAt != nil && !status.ExpiresAt.After(time.Now()):
+		return nil, domain.ErrInvalidRequest.WithMessage("Status expiry must be in the future")
+	}
+
+	if status.Text == "" && status.Emoji == "" {
+		status.ExpiresAt = nil
+	}
+
+	if err := us.userRepo.SetUserStatus(ctx, userID, status); err != nil {
+		logger.FromContext(ctx).Error("Failed to set user status", "error", err)
+		return nil, err
+	}
+
+	us.heartbeat.PublishStatus(ctx, userID, status)
+	return status, nil
+}
+
+// SetDND replaces the user's do not disturb settings, empty settings turn it off.
+func (us *UserService) SetDND(ctx context.Context, userID int, dnd *domain.DNDSettings) (*domain.DNDSettings, error) {
+	if err := validateDND(dnd); err != nil {
+		return nil, err
+	}
+
+	if err := us.userRepo.SetDNDSettings(ctx, userID, dnd); err != nil {
+		logger.FromContext(ctx).Error("Failed to set do not disturb", "error", err)
+		return nil, err
+	}
+
+	dnd.Active = dnd.IsActive(time.Now())
+	return dnd, nil
+}
+
+func validateDND(dnd *domain.DNDSettings) error {
+	if dnd.Until != nil && !dnd.Until.After(time.Now()) {
+		return domain.ErrInvalidRequest.WithMessage("Do not disturb end must be in the future")
+	}
+
+	if (dnd.ScheduleStart == nil) != (dnd.ScheduleEnd == nil) {
+		return domain.ErrInvalidRequest.WithMessage("Schedule needs both start and end")
+	}
+	if dnd.ScheduleStart == nil {
+		dnd.Timezone = nil
+		return nil
+	}
+
+	if *dnd.ScheduleStart == *dnd.ScheduleEnd {
+		return domain.ErrInvalidRequest.WithMessage("Schedule start and end must differ")
+	}
+	if dnd.Timezone == nil || *dnd.Timezone == "" {
+		return domain.ErrInvalidRequest.WithMessage("Schedule needs a timezone")
+	}
+	if _, err := time.LoadLocation(*dnd.Timezone); err != nil || *dnd.Timezone == "Local" || len(*dnd.Timezone) > 64 {
+		return domain.ErrInvalidRequest.WithMessage("Unknown timezone")
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TicketService issues short lived single use tickets that let browsers authenticate
+// the websocket handshake, where they can't set the Authorization header.
+type TicketService struct {
+	ticketRepo TicketRepoIn
+	ttl        time.Duration
+}
+
+func NewTicketService(ticketRepo TicketRepoIn, ttl time.Duration) TicketServiceIn {
+	return &TicketService{
+		ticketRepo: ticketRepo,
+		ttl:        ttl,
+	}
+}
+
+// IssueTicket binds a ticket to the caller's session, the websocket opened with it expires with the token.
+func (ts *TicketService) IssueTicket(ctx context.Context, session *Session) (string, time.Duration, error) {
+	ticket := uuid.NewString()
+	if err := ts.ticketRepo.SetWSTicket(ctx, ticket, session, ts.ttl); err != nil {
+		return "", 0, err
+	}
+	return ticket, ts.ttl, nil
+}
+
+func (ts *TicketService) RedeemTicket(ctx context.Context, ticket string) (*Session, error) {
+	return ts.ticketRepo.ConsumeWSTicket(ctx, ticket)
+}
@@ -0,0 +1,253 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ReilBleem13/MessangerV2/internal/domain"
+	"github.com/ReilBleem13/MessangerV2/internal/logger"
+)
+
+const (
+	defaultSearchUsersLimit = 20
+	maxSearchUsersLimit     = 50
+	maxSearchQueryLength    = 64
+
+	maxProfileTextLength = 2000
+	// users.*_url are VARCHAR(500)
+	maxProfileURLLength = 500
+)
+
+// hosts accepted for the social links, subdomains included. Empty list means any host
+var profileURLHosts = map[string][]string{
+	"github_url":   {"github.com"},
+	"linkedin_url": {"linkedin.com"},
+	"twitter_url":  {"twitter.com", "x.com"},
+	"telegram_url": {"t.me", "telegram.me"},
+	"website_url":  nil,
+}
+
+type UserService struct {
+	userRepo  UserRepoIn
+	msgRepo   MessageRepoIn
+	heartbeat HeartbeatServiceIn
+	hub       *Hub
+}
+
+func NewUserService(userRepo UserRepoIn, msgRepo MessageRepoIn, heartbeat HeartbeatServiceIn, hub *Hub) UserServiceIn {
+	return &UserService{
+		userRepo:  userRepo,
+		msgRepo:   msgRepo,
+		heartbeat: heartbeat,
+		hub:       hub,
+	}
+}
+
+func (us *UserService) GetProfile(ctx context.Context, viewerID, userID int) (*domain.UserProfile, error) {
+	profile, err := us.userRepo.GetUserProfile(ctx, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get user profile", "user_id", userID, "error", err)
+		return nil, err
+	}
+
+	now := time.Now()
+	if !profile.Status.IsSet(now) {
+		profile.Status = nil
+	}
+
+	if viewerID == userID {
+		profile.DND.Active = profile.DND.IsActive(now)
+		return profile, nil
+	}
+	hidePrivateFields(profile)
+
+	isContact := false
+	if profile.LastSeenPrivacy == domain.PrivacyContacts || profile.OnlineStatusPrivacy == domain.PrivacyContacts {
+		isContact, err = us.userRepo.AreContacts(ctx, viewerID, userID)
+		if err != nil {
+			logger.FromContext(ctx).Error("Failed to check contacts", "error", err)
+			return nil, err
+		}
+	}
+	if !profile.LastSeenPrivacy.Allows(isContact) {
+		profile.LastSeenAt = nil
+	}
+	// the status travels with presence, so it is visible to the same users
+	if !profile.OnlineStatusPrivacy.Allows(isContact) {
+		profile.Status = nil
+	}
+	return profile, nil
+}
+
+func (us *UserService) SearchUsers(ctx context.Context, in *SearchUsersDTO) ([]domain.UserSummary, *int, bool, error) {
+	in.Query = strings.TrimSpace(in.Query)
+	if in.Query == "" || utf8.RuneCountInString(in.Query) > maxSearchQueryLength {
+		return nil, nil, false, domain.ErrInvalidRequest.WithMessage("Search query must be 1 to 64 characters")
+	}
+	if in.Cursor != nil && *in.Cursor < 0 {
+		return nil, nil, false, domain.ErrInvalidRequest
+	}
+
+	switch {
+	case in.Limit <= 0:
+		in.Limit = defaultSearchUsersLimit
+	case in.Limit > maxSearchUsersLimit:
+		in.Limit = maxSearchUsersLimit
+	}
+
+	users, newCursor, hasMore, err := us.userRepo.SearchUsers(ctx, in)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to search users", "error", err)
+		return nil, nil, false, err
+	}
+	return users, newCursor, hasMore, nil
+}
+
+func (us *UserService) BlockUser(ctx context.Context, blockerID, blockedID int) error {
+	if blockerID == blockedID {
+		return domain.ErrInvalidRequest.WithMessage("Can't block yourself")
+	}
+
+	if err := us.userRepo.BlockUser(ctx, blockerID, blockedID); err != nil {
+		logger.FromContext(ctx).Error("Failed to block user", "blocked_id", blockedID, "error", err)
+		return err
+	}
+	return nil
+}
+
+func (us *UserService) UnblockUser(ctx context.Context, blockerID, blockedID int) error {
+	if err := us.userRepo.UnblockUser(ctx, blockerID, blockedID); err != nil {
+		logger.FromContext(ctx).Error("Failed to unblock user", "blocked_id", blockedID, "error", err)
+		return err
+	}
+	return nil
+}
+
+func (us *UserService) GetPrivacySettings(ctx context.Context, userID int) (*domain.PrivacySettings, error) {
+	settings, err := us.userRepo.GetPrivacySettings(ctx, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get privacy settings", "error", err)
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (us *UserService) UpdatePrivacySettings(ctx context.Context, userID int, in *UpdatePrivacyDTO) (*domain.PrivacySettings, error) {
+	for _, level := range []*domain.PrivacyLevel{in.OnlineStatus, in.LastSeen, in.GroupInvites, in.PrivateChats} {
+		if level != nil && !level.Valid() {
+			return nil, domain.ErrInvalidRequest.WithMessage("Privacy level must be everyone, contacts or nobody")
+		}
+	}
+
+	settings, err := us.userRepo.UpdatePrivacySettings(ctx, userID, in)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to update privacy settings", "error", err)
+		return nil, err
+	}
+	return settings, nil
+}
+
+// hidePrivateFields strips what only the user themselves may see
+func hidePrivateFields(profile *domain.UserProfile) {
+	profile.Email = ""
+	profile.Discoverable = nil
+	profile.DND = nil
+}
+
+func (us *UserService) UpdateProfile(ctx context.Context, userID int, in *UpdateProfileDTO) (*domain.UserProfile, error) {
+	if err := validateProfile(in); err != nil {
+		return nil, err
+	}
+
+	profile, err := us.userRepo.UpdateUserProfile(ctx, userID, in)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to update user profile", "error", err)
+		return nil, err
+	}
+
+	contacts, err := us.msgRepo.GetUserContacts(ctx, userID)
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to get user contacts", "error", err)
+		return profile, nil
+	}
+
+	if !profile.Status.IsSet(time.Now()) {
+		profile.Status = nil
+	}
+
+	public := *profile
+	hidePrivateFields(&public)
+	// presence events carry it, honoring privacy
+	public.LastSeenAt = nil
+
+	profileUpdatedEventByte, err := json.Marshal(&ProfileUpdatedEvent{
+		Profile: &public,
+	})
+	if err != nil {
+		logger.FromContext(ctx).Error("Failed to marshal data", "error", err)
+		return profile, nil
+	}
+
+	// the user's other sessions get it too
+	us.hub.broadcast(ctx, append(contacts, userID), &ProduceMessage{
+		Type: domain.ProfileUpdatedType,
+		Data: profileUpdatedEventByte,
+	})
+	return profile, nil
+}
+
+func validateProfile(in *UpdateProfileDTO) error {
+	texts := map[string]*string{
+		"about":      in.About,
+		"experience": in.Experience,
+	}
+	for field, value := range texts {
+		if value != nil && utf8.RuneCountInString(*value) > maxProfileTextLength {
+			return domain.ErrInvalidRequest.WithMessage(field + " is too long")
+		}
+	}
+
+	urls := map[string]*string{
+		"github_url":   in.GithubURL,
+		"linkedin_url": in.LinkedinURL,
+		"twitter_url":  in.TwitterURL,
+		"telegram_url": in.TelegramURL,
+		"website_url":  in.WebsiteURL,
+	}
+	for field, value := range urls {
+		if value == nil || *value == "" {
+			continue
+		}
+		if err := validateProfileURL(*value, profileURLHosts[field]); err != nil {
+			return domain.ErrInvalidRequest.WithMessage(field + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func validateProfileURL(raw string, hosts []string) error {
+	if len(raw) > maxProfileURLLength {
+		return domain.ErrInvalidRequest.WithMessage("url is too long")
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.User != nil {
+		return domain.ErrInvalidRequest.WithMessage("must be an absolute http(s) url")
+	}
+
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range hosts {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return nil
+		}
+	}
+	return domain.ErrInvalidRequest.WithMessage("must point to " + strings.Join(hosts, " or "))
+}